@@ -0,0 +1,347 @@
+// Package benchmark implements the -benchmark command-line flags shared by
+// the examples, which run a network repeatedly after some untimed warmup runs
+// and report latency percentiles and throughput. The time taken by each stage
+// of a run (e.g., preprocessing, inference and postprocessing) is reported
+// separately, and the results can be written as JSON so that runs using
+// different onnxruntime versions or settings can be compared.
+package benchmark
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// The names of the stages used by the examples. Any other names may be
+// passed to Timer.Stage, too.
+const (
+	Preprocess  = "preprocess"
+	Inference   = "inference"
+	Postprocess = "postprocess"
+)
+
+// Holds the benchmark settings from the command line.
+type Config struct {
+	// The number of timed runs. Benchmarking is disabled if this is 0.
+	Runs int
+	// The number of untimed runs before the timed ones.
+	WarmupRuns int
+	// If non-empty, the results are also written to this path as JSON.
+	JSONPath string
+}
+
+// Registers the -benchmark, -benchmark_warmup and -benchmark_json flags with
+// the flag package, and returns the Config that will hold their values after
+// flag.Parse() is called.
+func AddFlags() *Config {
+	c := &Config{}
+	flag.IntVar(&c.Runs, "benchmark", 0,
+		"If positive, run the network this many times after the "+
+			"-benchmark_warmup runs, and print latency percentiles and "+
+			"throughput for each stage.")
+	flag.IntVar(&c.WarmupRuns, "benchmark_warmup", 5,
+		"The number of untimed runs before the timed -benchmark runs, "+
+			"allowing onnxruntime to finish any lazy initialization.")
+	flag.StringVar(&c.JSONPath, "benchmark_json", "",
+		"If set, the -benchmark results are also written to this path as "+
+			"JSON, for comparing runs with different onnxruntime versions or "+
+			"settings.")
+	return c
+}
+
+// Returns an error if any of the settings are invalid.
+func (c *Config) Validate() error {
+	if c.Runs < 0 {
+		return fmt.Errorf("The number of benchmark runs can't be negative")
+	}
+	if c.WarmupRuns < 0 {
+		return fmt.Errorf("The number of warmup runs can't be negative")
+	}
+	return nil
+}
+
+// Returns true if the -benchmark flag requested any timed runs.
+func (c *Config) Enabled() bool {
+	return c.Runs > 0
+}
+
+// Calls fn WarmupRuns times, then discards anything recorded by the timer
+// and calls fn Runs more times, finishing one run of the timer after each
+// call. fn is expected to call t.Stage before each stage of its work. Each
+// call is counted as processing itemsPerRun items (e.g., images) for the
+// purpose of computing throughput. Returns the timed runs' results, with the
+// given name. onnxruntime must already be initialized.
+func (c *Config) Run(name string, t *Timer, itemsPerRun int,
+	fn func() error) (*Result, error) {
+	for i := 0; i < c.WarmupRuns; i++ {
+		e := fn()
+		if e != nil {
+			return nil, fmt.Errorf("Error in warmup run %d: %w", i+1, e)
+		}
+		t.Finish(itemsPerRun)
+	}
+	t.Reset()
+	for i := 0; i < c.Runs; i++ {
+		e := fn()
+		if e != nil {
+			return nil, fmt.Errorf("Error in benchmark run %d: %w", i+1, e)
+		}
+		t.Finish(itemsPerRun)
+	}
+	result := t.Result(name)
+	result.WarmupRuns = c.WarmupRuns
+	return result, nil
+}
+
+// Prints a summary of the results to the given writer, and writes them as
+// JSON if -benchmark_json was set. The summary isn't printed if the writer is
+// nil.
+func (c *Config) Report(r *Result, summary io.Writer) error {
+	if summary != nil {
+		r.Print(summary)
+	}
+	if c.JSONPath == "" {
+		return nil
+	}
+	f, e := os.Create(c.JSONPath)
+	if e != nil {
+		return fmt.Errorf("Error creating %s: %w", c.JSONPath, e)
+	}
+	e = r.WriteJSON(f)
+	if e != nil {
+		f.Close()
+		return e
+	}
+	return f.Close()
+}
+
+// Records how long each stage of a series of runs takes. Not safe for
+// concurrent use.
+type Timer struct {
+	// The names of the stages, in the order they were first seen.
+	stageNames []string
+	// The time spent in each stage during each run, by stage name.
+	samples map[string][]time.Duration
+	// The total time taken by each run.
+	totals []time.Duration
+	items  int
+	// Information about the run in progress, if running is true.
+	running       bool
+	runStart      time.Time
+	current       string
+	currentStart  time.Time
+	runStageNames []string
+	runStages     map[string]time.Duration
+}
+
+func NewTimer() *Timer {
+	t := &Timer{}
+	t.Reset()
+	return t
+}
+
+// Discards everything recorded so far, including any run in progress.
+func (t *Timer) Reset() {
+	t.stageNames = nil
+	t.samples = make(map[string][]time.Duration)
+	t.totals = nil
+	t.items = 0
+	t.Discard()
+}
+
+// Ends the current stage, if any, and starts timing the named stage, starting
+// a new run if one isn't in progress. If a stage is entered several times
+// during one run, its times are added together.
+func (t *Timer) Stage(name string) {
+	now := time.Now()
+	if !t.running {
+		t.running = true
+		t.runStart = now
+	} else {
+		t.endStage(now)
+	}
+	t.current = name
+	t.currentStart = now
+}
+
+// Adds the time spent in the current stage to the run in progress.
+func (t *Timer) endStage(now time.Time) {
+	if _, ok := t.runStages[t.current]; !ok {
+		t.runStageNames = append(t.runStageNames, t.current)
+	}
+	t.runStages[t.current] += now.Sub(t.currentStart)
+}
+
+// Ends the run in progress, counting it as processing the given number of
+// items. Does nothing if no stage has been started since the last run ended.
+func (t *Timer) Finish(items int) {
+	if !t.running {
+		return
+	}
+	now := time.Now()
+	t.endStage(now)
+	for _, name := range t.runStageNames {
+		if _, ok := t.samples[name]; !ok {
+			t.stageNames = append(t.stageNames, name)
+		}
+		t.samples[name] = append(t.samples[name], t.runStages[name])
+	}
+	t.totals = append(t.totals, now.Sub(t.runStart))
+	t.items += items
+	t.Discard()
+}
+
+// Discards the run in progress, if any, e.g., if it failed partway through.
+func (t *Timer) Discard() {
+	t.running = false
+	t.current = ""
+	t.runStageNames = nil
+	t.runStages = make(map[string]time.Duration)
+}
+
+// Returns the number of finished runs.
+func (t *Timer) Runs() int {
+	return len(t.totals)
+}
+
+// Latency statistics for one stage, or for entire runs, in milliseconds.
+type Stats struct {
+	Count  int     `json:"count"`
+	MeanMS float64 `json:"mean_ms"`
+	MinMS  float64 `json:"min_ms"`
+	P50MS  float64 `json:"p50_ms"`
+	P90MS  float64 `json:"p90_ms"`
+	P99MS  float64 `json:"p99_ms"`
+	MaxMS  float64 `json:"max_ms"`
+}
+
+type StageStats struct {
+	Name string `json:"name"`
+	Stats
+}
+
+// The results of a benchmark, in the format written by WriteJSON.
+type Result struct {
+	Name               string `json:"name"`
+	ONNXRuntimeVersion string `json:"onnxruntime_version"`
+	GoVersion          string `json:"go_version"`
+	OS                 string `json:"os"`
+	Arch               string `json:"arch"`
+	WarmupRuns         int    `json:"warmup_runs"`
+	Runs               int    `json:"runs"`
+	Items              int    `json:"items"`
+	// The number of items processed per second of time spent in the timed
+	// runs, excluding any time spent between runs.
+	ItemsPerSecond float64      `json:"items_per_second"`
+	Total          Stats        `json:"total"`
+	Stages         []StageStats `json:"stages"`
+}
+
+// Returns the value at the given percentile of the sorted durations, using
+// the nearest-rank method, in milliseconds.
+func percentile(sorted []time.Duration, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return toMS(sorted[rank-1])
+}
+
+func toMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Computes the statistics for the given durations.
+func computeStats(durations []time.Duration) Stats {
+	if len(durations) == 0 {
+		return Stats{}
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a] < sorted[b]
+	})
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	return Stats{
+		Count:  len(sorted),
+		MeanMS: toMS(sum) / float64(len(sorted)),
+		MinMS:  toMS(sorted[0]),
+		P50MS:  percentile(sorted, 50),
+		P90MS:  percentile(sorted, 90),
+		P99MS:  percentile(sorted, 99),
+		MaxMS:  toMS(sorted[len(sorted)-1]),
+	}
+}
+
+// Returns the statistics for the finished runs, with the given name.
+// onnxruntime must already be initialized, in order to record its version.
+func (t *Timer) Result(name string) *Result {
+	toReturn := &Result{
+		Name:               name,
+		ONNXRuntimeVersion: ort.GetVersion(),
+		GoVersion:          runtime.Version(),
+		OS:                 runtime.GOOS,
+		Arch:               runtime.GOARCH,
+		Runs:               len(t.totals),
+		Items:              t.items,
+		Total:              computeStats(t.totals),
+		Stages:             make([]StageStats, 0, len(t.stageNames)),
+	}
+	var totalTime time.Duration
+	for _, d := range t.totals {
+		totalTime += d
+	}
+	if totalTime > 0 {
+		toReturn.ItemsPerSecond = float64(t.items) / totalTime.Seconds()
+	}
+	for _, name := range t.stageNames {
+		toReturn.Stages = append(toReturn.Stages, StageStats{
+			Name:  name,
+			Stats: computeStats(t.samples[name]),
+		})
+	}
+	return toReturn
+}
+
+// Prints a table of the results to the given writer.
+func (r *Result) Print(w io.Writer) {
+	fmt.Fprintf(w, "Benchmark results for %s (onnxruntime %s): %d runs "+
+		"after %d warmup runs\n", r.Name, r.ONNXRuntimeVersion, r.Runs,
+		r.WarmupRuns)
+	fmt.Fprintf(w, "  %-12s %10s %10s %10s %10s %10s %10s\n", "Stage (ms)",
+		"Mean", "Min", "p50", "p90", "p99", "Max")
+	printRow := func(name string, s *Stats) {
+		fmt.Fprintf(w, "  %-12s %10.3f %10.3f %10.3f %10.3f %10.3f %10.3f\n",
+			name, s.MeanMS, s.MinMS, s.P50MS, s.P90MS, s.P99MS, s.MaxMS)
+	}
+	for i := range r.Stages {
+		printRow(r.Stages[i].Name, &r.Stages[i].Stats)
+	}
+	printRow("total", &r.Total)
+	fmt.Fprintf(w, "  Throughput: %.2f items/second (%d items)\n",
+		r.ItemsPerSecond, r.Items)
+}
+
+// Writes the results to the given writer as indented JSON.
+func (r *Result) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	e := encoder.Encode(r)
+	if e != nil {
+		return fmt.Errorf("Error writing benchmark results: %w", e)
+	}
+	return nil
+}
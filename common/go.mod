@@ -0,0 +1,5 @@
+module github.com/yalue/onnxruntime_go_examples/common
+
+go 1.20
+
+require github.com/yalue/onnxruntime_go v1.25.0
@@ -0,0 +1,142 @@
+package imageutil
+
+// This file contains the code for reading the EXIF orientation tag from JPEG
+// files, such as photos taken by phones, and applying it to decoded images.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+)
+
+// The EXIF tag holding the image's orientation.
+const exifOrientationTag = 0x0112
+
+// Returns the EXIF orientation, from 1 to 8, of the given JPEG file data.
+// Returns 1, meaning the image doesn't need to be transformed, if the data
+// doesn't contain a valid orientation tag.
+func JPEGOrientation(data []byte) int {
+	if (len(data) < 4) || (data[0] != 0xff) || (data[1] != 0xd8) {
+		return 1
+	}
+	// Walk the JPEG segments until finding the APP1 segment containing the
+	// EXIF data, stopping at the start of the compressed image data.
+	offset := 2
+	for (offset + 4) <= len(data) {
+		if data[offset] != 0xff {
+			return 1
+		}
+		marker := data[offset+1]
+		if (marker == 0xd8) || (marker == 0x01) ||
+			((marker >= 0xd0) && (marker <= 0xd7)) {
+			// These markers aren't followed by a segment length.
+			offset += 2
+			continue
+		}
+		if (marker == 0xda) || (marker == 0xd9) {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		if (length < 2) || ((offset + 2 + length) > len(data)) {
+			return 1
+		}
+		segment := data[offset+4 : offset+2+length]
+		if (marker == 0xe1) && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		offset += 2 + length
+	}
+	return 1
+}
+
+// Returns the orientation tag from the first IFD of the given TIFF-format
+// EXIF data, or 1 if it isn't present.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 1
+	}
+	ifdOffset := int(order.Uint32(tiff[4:]))
+	if (ifdOffset < 8) || ((ifdOffset + 2) > len(tiff)) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifdOffset:]))
+	for i := 0; i < count; i++ {
+		entry := ifdOffset + 2 + i*12
+		if (entry + 12) > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		// The orientation is a single SHORT, stored at the start of the
+		// entry's 4-byte value field.
+		if order.Uint16(tiff[entry+2:]) != 3 {
+			return 1
+		}
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if (orientation < 1) || (orientation > 8) {
+			return 1
+		}
+		return orientation
+	}
+	return 1
+}
+
+// Returns a copy of pic rotated and/or flipped so that it's displayed upright
+// according to the given EXIF orientation. Returns pic unchanged if the
+// orientation is 1 or invalid.
+func ApplyOrientation(pic image.Image, orientation int) image.Image {
+	if (orientation <= 1) || (orientation > 8) {
+		return pic
+	}
+	bounds := pic.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	// Converting to RGBA first is much faster than calling At for each
+	// pixel, and doesn't lose anything for the 8-bit images stored in JPEGs.
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), pic, bounds.Min, draw.Src)
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		// Orientations 5 through 8 swap the width and height.
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			// Find the source pixel that ends up at (x, y).
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				sx, sy = w-1-x, y
+			case 3: // Rotated 180 degrees
+				sx, sy = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // Mirrored along the top-left to bottom-right diagonal
+				sx, sy = y, x
+			case 6: // Needs a 90 degree clockwise rotation
+				sx, sy = y, h-1-x
+			case 7: // Mirrored along the top-right to bottom-left diagonal
+				sx, sy = w-1-y, h-1-x
+			case 8: // Needs a 90 degree counterclockwise rotation
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4],
+				src.Pix[src.PixOffset(sx, sy):])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,170 @@
+package imageutil
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// Returns TIFF-format EXIF data with a single IFD entry holding the given
+// orientation, using the given byte order.
+func buildTIFF(order binary.ByteOrder, orientation uint16) []byte {
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	entry := tiff[10:]
+	order.PutUint16(entry, exifOrientationTag)
+	// A single SHORT value.
+	order.PutUint16(entry[2:], 3)
+	order.PutUint32(entry[4:], 1)
+	order.PutUint16(entry[8:], orientation)
+	return tiff
+}
+
+// Returns the start of a JPEG file containing an APP0 segment followed by an
+// APP1 segment with the given EXIF data.
+func buildJPEG(tiff []byte) []byte {
+	data := []byte{0xff, 0xd8}
+	// A JFIF APP0 segment, which must be skipped over.
+	data = append(data, 0xff, 0xe0, 0x00, 0x07, 'J', 'F', 'I', 'F', 0)
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	data = append(data, 0xff, 0xe1, 0, 0)
+	binary.BigEndian.PutUint16(data[len(data)-2:], uint16(len(payload)+2))
+	data = append(data, payload...)
+	// The start of the compressed image data.
+	return append(data, 0xff, 0xda, 0x00, 0x02)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	for orientation := uint16(1); orientation <= 8; orientation++ {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian,
+			binary.BigEndian} {
+			data := buildJPEG(buildTIFF(order, orientation))
+			o := JPEGOrientation(data)
+			if o != int(orientation) {
+				t.Fatalf("Expected orientation %d using %s, got %d",
+					orientation, order, o)
+			}
+		}
+	}
+}
+
+func TestJPEGOrientationInvalid(t *testing.T) {
+	valid := buildJPEG(buildTIFF(binary.BigEndian, 6))
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"garbage", []byte("This isn't a JPEG file at all")},
+		{"only the SOI marker", []byte{0xff, 0xd8}},
+		{"not a marker", []byte{0xff, 0xd8, 0x12, 0x34, 0x56, 0x78}},
+		{"segment length too short", []byte{0xff, 0xd8, 0xff, 0xe1, 0, 1}},
+		{"segment length too long", []byte{0xff, 0xd8, 0xff, 0xe1, 0xff,
+			0xff, 'E', 'x', 'i', 'f', 0, 0}},
+		{"no EXIF header", []byte{0xff, 0xd8, 0xff, 0xe1, 0, 6, 'J', 'U', 'N',
+			'K'}},
+		{"bad byte order", buildJPEG(append([]byte("XX"),
+			buildTIFF(binary.BigEndian, 6)[2:]...))},
+		{"bad TIFF magic number", buildJPEG(append([]byte("MM\x00\x2b"),
+			buildTIFF(binary.BigEndian, 6)[4:]...))},
+		{"orientation out of range", buildJPEG(buildTIFF(binary.BigEndian,
+			9))},
+		{"orientation of 0", buildJPEG(buildTIFF(binary.LittleEndian, 0))},
+	}
+	// Every truncation of a valid file, which must never read past the end
+	// of the data.
+	for i := 0; i < (len(valid) - 4); i++ {
+		tests = append(tests, struct {
+			name string
+			data []byte
+		}{"truncated", valid[:i]})
+	}
+	for _, test := range tests {
+		o := JPEGOrientation(test.data)
+		if o != 1 {
+			t.Fatalf("Expected orientation 1 for %s data (%d bytes), got %d",
+				test.name, len(test.data), o)
+		}
+	}
+
+	// An IFD entry count larger than the data should be ignored rather than
+	// read past the end.
+	tiff := buildTIFF(binary.LittleEndian, 6)
+	binary.LittleEndian.PutUint16(tiff[8:], 1000)
+	// Change the first entry's tag so that the second entry is read.
+	binary.LittleEndian.PutUint16(tiff[10:], 0x0100)
+	if o := JPEGOrientation(buildJPEG(tiff)); o != 1 {
+		t.Fatalf("Expected orientation 1 for a bad IFD entry count, got %d", o)
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// A 3x2 image, so swapping the width and height is noticeable.
+	const w, h = 3, 2
+	topLeft := color.RGBA{255, 0, 0, 255}
+	topRight := color.RGBA{0, 255, 0, 255}
+	bottomLeft := color.RGBA{0, 0, 255, 255}
+	bottomRight := color.RGBA{255, 255, 0, 255}
+	pic := image.NewRGBA(image.Rect(0, 0, w, h))
+	pic.Set(0, 0, topLeft)
+	pic.Set(w-1, 0, topRight)
+	pic.Set(0, h-1, bottomLeft)
+	pic.Set(w-1, h-1, bottomRight)
+
+	// The source corners that end up in the top left, top right, bottom left
+	// and bottom right of the result, for each orientation.
+	tests := []struct {
+		orientation int
+		corners     [4]color.RGBA
+	}{
+		{1, [4]color.RGBA{topLeft, topRight, bottomLeft, bottomRight}},
+		{2, [4]color.RGBA{topRight, topLeft, bottomRight, bottomLeft}},
+		{3, [4]color.RGBA{bottomRight, bottomLeft, topRight, topLeft}},
+		{4, [4]color.RGBA{bottomLeft, bottomRight, topLeft, topRight}},
+		{5, [4]color.RGBA{topLeft, bottomLeft, topRight, bottomRight}},
+		{6, [4]color.RGBA{bottomLeft, topLeft, bottomRight, topRight}},
+		{7, [4]color.RGBA{bottomRight, topRight, bottomLeft, topLeft}},
+		{8, [4]color.RGBA{topRight, bottomRight, topLeft, bottomLeft}},
+	}
+	for _, test := range tests {
+		result := ApplyOrientation(pic, test.orientation)
+		bounds := result.Bounds()
+		expectedW, expectedH := w, h
+		if test.orientation >= 5 {
+			expectedW, expectedH = h, w
+		}
+		if (bounds.Dx() != expectedW) || (bounds.Dy() != expectedH) {
+			t.Fatalf("Expected a %dx%d image for orientation %d, got %dx%d",
+				expectedW, expectedH, test.orientation, bounds.Dx(),
+				bounds.Dy())
+		}
+		points := []image.Point{
+			{bounds.Min.X, bounds.Min.Y},
+			{bounds.Max.X - 1, bounds.Min.Y},
+			{bounds.Min.X, bounds.Max.Y - 1},
+			{bounds.Max.X - 1, bounds.Max.Y - 1},
+		}
+		for i, p := range points {
+			c := color.RGBAModel.Convert(result.At(p.X, p.Y)).(color.RGBA)
+			if c != test.corners[i] {
+				t.Fatalf("Expected %v at %v for orientation %d, got %v",
+					test.corners[i], p, test.orientation, c)
+			}
+		}
+	}
+
+	// Invalid orientations leave the image unchanged.
+	for _, orientation := range []int{0, 9, -1} {
+		if ApplyOrientation(pic, orientation) != image.Image(pic) {
+			t.Fatalf("Orientation %d changed the image", orientation)
+		}
+	}
+}
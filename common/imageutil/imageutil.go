@@ -0,0 +1,98 @@
+// Package imageutil contains the image-loading code shared by the examples
+// that take images as input. Images are decoded using any format registered
+// with the standard image package, rotated or flipped according to their
+// EXIF orientation, and composited onto an opaque background if they contain
+// transparency.
+package imageutil
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The background used when one isn't specified.
+var DefaultBackground color.Color = color.White
+
+// Loads and decodes the image file at the given path, applying its EXIF
+// orientation and compositing it onto the given background color. If
+// background is nil, DefaultBackground is used.
+func Load(path string, background color.Color) (image.Image, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, fmt.Errorf("Error opening %s: %w", path, e)
+	}
+	defer f.Close()
+	pic, e := Decode(f, background)
+	if e != nil {
+		return nil, fmt.Errorf("Error decoding %s: %w", path, e)
+	}
+	return pic, nil
+}
+
+// Like Load, but decodes an image from r rather than from a file.
+func Decode(r io.Reader, background color.Color) (image.Image, error) {
+	data, e := io.ReadAll(r)
+	if e != nil {
+		return nil, fmt.Errorf("Error reading image data: %w", e)
+	}
+	pic, format, e := image.Decode(bytes.NewReader(data))
+	if e != nil {
+		return nil, e
+	}
+	if format == "jpeg" {
+		pic = ApplyOrientation(pic, JPEGOrientation(data))
+	}
+	return Flatten(pic, background), nil
+}
+
+// Returns a copy of pic composited onto the given background color, so that
+// transparent pixels take on the background's color rather than becoming
+// black. Returns pic unchanged if it's already opaque. If background is nil,
+// DefaultBackground is used.
+func Flatten(pic image.Image, background color.Color) image.Image {
+	if o, ok := pic.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return pic
+	}
+	if background == nil {
+		background = DefaultBackground
+	}
+	bounds := pic.Bounds()
+	toReturn := image.NewRGBA(bounds)
+	draw.Draw(toReturn, bounds, image.NewUniform(background), image.Point{},
+		draw.Src)
+	draw.Draw(toReturn, bounds, pic, bounds.Min, draw.Over)
+	return toReturn
+}
+
+// Parses a background color given either as a hex string in the form
+// "#rrggbb" or "#rgb" (the "#" is optional), or as one of the names "white",
+// "black" or "gray".
+func ParseColor(s string) (color.Color, error) {
+	switch strings.ToLower(s) {
+	case "white":
+		return color.White, nil
+	case "black":
+		return color.Black, nil
+	case "gray", "grey":
+		return color.RGBA{0x80, 0x80, 0x80, 0xff}, nil
+	}
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return nil, fmt.Errorf("Invalid color %q: expected #rrggbb", s)
+	}
+	v, e := strconv.ParseUint(hex, 16, 32)
+	if e != nil {
+		return nil, fmt.Errorf("Invalid color %q: %w", s, e)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}, nil
+}
@@ -0,0 +1,304 @@
+// Package ortlib locates and loads the onnxruntime shared library for the
+// examples. If a path is given by the -onnxruntime_lib flag or, failing that,
+// the ONNXRUNTIME_LIB environment variable, only that library is used, and
+// the reason it can't be loaded is reported if it doesn't work. Otherwise,
+// rather than requiring a path to the library, it tries each of the
+// following locations in order, using the first library that loads and
+// reports a compatible version:
+//
+//  1. The directory containing the running executable.
+//  2. The copies of the library in this repository's third_party directory.
+//  3. The directories in LD_LIBRARY_PATH (DYLD_LIBRARY_PATH on macOS, or
+//     PATH on Windows).
+//  4. On Linux, the libraries known to the dynamic linker's ldconfig cache.
+//
+// If none of them work, the returned error lists every path that was tried,
+// along with the reason it was rejected.
+package ortlib
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// The environment variable that may hold the path to the library.
+const EnvVar = "ONNXRUNTIME_LIB"
+
+// Libraries reporting an older version than this are rejected. This is the
+// version of the C API used by the onnxruntime_go wrapper.
+var MinimumVersion = "1.23.0"
+
+// Registers the -onnxruntime_lib flag with the flag package, and returns a
+// pointer to the string that will hold its value after flag.Parse() is
+// called. Pass the value to Initialize.
+func AddFlag() *string {
+	return flag.String("onnxruntime_lib", "",
+		"The path to the onnxruntime shared library for your system. "+
+			"Overrides the "+EnvVar+" environment variable. If neither is "+
+			"set, the executable's directory, ../third_party and the system "+
+			"library paths are searched.")
+}
+
+// A library path to try, along with where it came from.
+type candidate struct {
+	path   string
+	source string
+}
+
+// Records a path that was tried and why it wasn't used.
+type Attempt struct {
+	Path   string
+	Source string
+	Err    error
+}
+
+// Returned by Initialize if no usable library was found.
+type NotFoundError struct {
+	Attempts []Attempt
+	// True if the library's path was given by the -onnxruntime_lib flag or
+	// the environment variable, in which case it's the only attempt.
+	Explicit bool
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Explicit && (len(e.Attempts) == 1) {
+		a := e.Attempts[0]
+		return fmt.Sprintf("Unable to load the onnxruntime library given by "+
+			"the %s, %s: %s\nCorrect the path (onnxruntime %s or later is "+
+			"required), or unset it to search the default locations",
+			a.Source, a.Path, a.Err, MinimumVersion)
+	}
+	var b strings.Builder
+	b.WriteString("Unable to load a compatible onnxruntime library")
+	if len(e.Attempts) == 0 {
+		b.WriteString("; no candidate paths were found")
+	} else {
+		b.WriteString(". Tried:")
+		for _, a := range e.Attempts {
+			fmt.Fprintf(&b, "\n  %s (%s): %s", a.Path, a.Source, a.Err)
+		}
+	}
+	fmt.Fprintf(&b, "\nSet the -onnxruntime_lib flag or the %s "+
+		"environment variable to the path of onnxruntime %s or later",
+		EnvVar, MinimumVersion)
+	return b.String()
+}
+
+// Returns the file names the library may have on this OS. The names used in
+// the third_party directory come first.
+func libraryNames() []string {
+	switch runtime.GOOS {
+	case "windows":
+		return []string{"onnxruntime.dll"}
+	case "darwin":
+		return []string{"onnxruntime_" + runtime.GOARCH + ".dylib",
+			"libonnxruntime.dylib", "onnxruntime.dylib"}
+	}
+	names := []string{"onnxruntime.so", "libonnxruntime.so",
+		"libonnxruntime.so.1"}
+	if runtime.GOARCH == "arm64" {
+		names = append([]string{"onnxruntime_arm64.so"}, names...)
+	}
+	return names
+}
+
+// Returns the path of the library in this repository's third_party
+// directory for the current OS and architecture, relative to an example's
+// directory, or an empty string if there isn't one.
+func thirdPartyPath() string {
+	switch runtime.GOOS {
+	case "windows":
+		if runtime.GOARCH == "amd64" {
+			return "../third_party/onnxruntime.dll"
+		}
+	case "darwin":
+		if (runtime.GOARCH == "arm64") || (runtime.GOARCH == "amd64") {
+			return "../third_party/onnxruntime_" + runtime.GOARCH + ".dylib"
+		}
+	case "linux":
+		if runtime.GOARCH == "arm64" {
+			return "../third_party/onnxruntime_arm64.so"
+		}
+		return "../third_party/onnxruntime.so"
+	}
+	return ""
+}
+
+// Returns the environment variable listing the directories searched for
+// shared libraries on this OS.
+func libraryPathVar() string {
+	switch runtime.GOOS {
+	case "windows":
+		return "PATH"
+	case "darwin":
+		return "DYLD_LIBRARY_PATH"
+	}
+	return "LD_LIBRARY_PATH"
+}
+
+// Returns the onnxruntime libraries listed in the ldconfig cache. Returns
+// nil if ldconfig isn't available.
+func ldconfigLibraries() []string {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	var output []byte
+	var e error
+	for _, command := range []string{"ldconfig", "/sbin/ldconfig"} {
+		output, e = exec.Command(command, "-p").Output()
+		if e == nil {
+			break
+		}
+	}
+	if e != nil {
+		return nil
+	}
+	// Each line looks like:
+	// "	libonnxruntime.so.1 (libc6,x86-64) => /usr/lib/libonnxruntime.so.1"
+	var toReturn []string
+	for _, line := range strings.Split(string(output), "\n") {
+		name, path, found := strings.Cut(line, "=>")
+		name = strings.TrimSpace(name)
+		if !found || !strings.HasPrefix(name, "libonnxruntime.so") {
+			continue
+		}
+		toReturn = append(toReturn, strings.TrimSpace(path))
+	}
+	return toReturn
+}
+
+// Returns the library path given by the -onnxruntime_lib flag or the
+// environment variable, if either is set. The flag takes precedence.
+func explicitCandidate(flagPath string) (candidate, bool) {
+	if flagPath != "" {
+		return candidate{path: flagPath, source: "-onnxruntime_lib flag"},
+			true
+	}
+	if path := os.Getenv(EnvVar); path != "" {
+		return candidate{path: path, source: EnvVar + " environment variable"},
+			true
+	}
+	return candidate{}, false
+}
+
+// Returns every path to search when no path was given explicitly, in order,
+// without duplicates.
+func candidates() []candidate {
+	var toReturn []candidate
+	seen := make(map[string]bool)
+	add := func(path, source string) {
+		if path == "" {
+			return
+		}
+		key := filepath.Clean(path)
+		if abs, e := filepath.Abs(path); e == nil {
+			key = abs
+		}
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		toReturn = append(toReturn, candidate{path: path, source: source})
+	}
+	addDir := func(dir, source string) {
+		for _, name := range libraryNames() {
+			add(filepath.Join(dir, name), source)
+		}
+	}
+
+	executable, e := os.Executable()
+	if e == nil {
+		addDir(filepath.Dir(executable), "executable's directory")
+	}
+	add(thirdPartyPath(), "third_party directory")
+	pathVar := libraryPathVar()
+	for _, dir := range filepath.SplitList(os.Getenv(pathVar)) {
+		if dir != "" {
+			addDir(dir, pathVar)
+		}
+	}
+	for _, path := range ldconfigLibraries() {
+		add(path, "ldconfig cache")
+	}
+	return toReturn
+}
+
+// Returns true if version a is older than version b, comparing each
+// dot-separated number in turn.
+func versionLess(a, b string) bool {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; (i < len(aParts)) || (i < len(bParts)); i++ {
+		var aValue, bValue int
+		if i < len(aParts) {
+			aValue, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bValue, _ = strconv.Atoi(bParts[i])
+		}
+		if aValue != bValue {
+			return aValue < bValue
+		}
+	}
+	return false
+}
+
+// Tries to initialize onnxruntime using the library at the given path,
+// leaving it initialized only if the library's version is compatible.
+func tryLibrary(path string) (string, error) {
+	if _, e := os.Stat(path); e != nil {
+		return "", fmt.Errorf("file not found")
+	}
+	ort.SetSharedLibraryPath(path)
+	e := ort.InitializeEnvironment()
+	if e != nil {
+		return "", e
+	}
+	version := ort.GetVersion()
+	if versionLess(version, MinimumVersion) {
+		ort.DestroyEnvironment()
+		return "", fmt.Errorf("version %s is older than the required %s",
+			version, MinimumVersion)
+	}
+	return version, nil
+}
+
+// Finds the onnxruntime shared library and initializes the onnxruntime
+// environment using it, as described in the package documentation. flagPath
+// is the value of the -onnxruntime_lib flag, and may be empty. Logs the path
+// and version of the library to stderr, and returns the path. Returns a
+// *NotFoundError listing every path that was tried if none of them can be
+// used. On success, the caller must call ort.DestroyEnvironment() when done.
+func Initialize(flagPath string) (string, error) {
+	var toTry []candidate
+	explicit, isExplicit := explicitCandidate(flagPath)
+	if isExplicit {
+		toTry = []candidate{explicit}
+	} else {
+		toTry = candidates()
+	}
+	var attempts []Attempt
+	for _, c := range toTry {
+		version, e := tryLibrary(c.path)
+		if e != nil {
+			attempts = append(attempts, Attempt{
+				Path:   c.path,
+				Source: c.source,
+				Err:    e,
+			})
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Using onnxruntime %s from %s\n", version,
+			c.path)
+		return c.path, nil
+	}
+	return "", &NotFoundError{Attempts: attempts, Explicit: isExplicit}
+}
@@ -0,0 +1,181 @@
+// Package provider implements the -provider and -provider_options
+// command-line flags shared by the examples, which select the onnxruntime
+// execution provider (i.e., the hardware acceleration backend) used to run
+// each network. If the selected provider can't be enabled, for example
+// because the onnxruntime library wasn't built with support for it, the
+// network runs on the CPU instead.
+package provider
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// The names of the supported execution providers.
+var Names = []string{"cpu", "coreml", "cuda", "tensorrt", "openvino",
+	"directml"}
+
+// Holds the execution provider settings from the command line.
+type Config struct {
+	// One of Names.
+	Name string
+	// Provider-specific options, as a comma-separated list of key=value
+	// pairs, e.g. "device_id=1,gpu_mem_limit=2147483648" for CUDA.
+	Options string
+}
+
+// Registers the -provider and -provider_options flags with the flag package,
+// and returns the Config that will hold their values after flag.Parse() is
+// called.
+func AddFlags() *Config {
+	c := &Config{}
+	flag.StringVar(&c.Name, "provider", "cpu",
+		"The onnxruntime execution provider to run the network with. Must "+
+			"be one of "+strings.Join(Names, ", ")+". Falls back to the "+
+			"CPU if the provider can't be enabled.")
+	flag.StringVar(&c.Options, "provider_options", "",
+		"Options for the -provider, as a comma-separated list of key=value "+
+			"pairs, e.g. \"device_id=1\". See the onnxruntime documentation "+
+			"for each provider's options.")
+	return c
+}
+
+// Returns an error if the provider's name isn't one of Names or its options
+// can't be parsed. Doesn't require onnxruntime to be initialized, so this
+// can be called immediately after parsing flags.
+func (c *Config) Validate() error {
+	found := false
+	for _, name := range Names {
+		found = found || (c.Name == name)
+	}
+	if !found {
+		return fmt.Errorf("Unknown execution provider %q. Must be one of %s",
+			c.Name, strings.Join(Names, ", "))
+	}
+	options, e := parseOptions(c.Options)
+	if e != nil {
+		return e
+	}
+	if (c.Name == "cpu") && (len(options) != 0) {
+		return fmt.Errorf("The cpu provider doesn't take any options")
+	}
+	if c.Name == "directml" {
+		for key := range options {
+			if key != "device_id" {
+				return fmt.Errorf("Unknown directml option %q. Only "+
+					"device_id is supported", key)
+			}
+		}
+	}
+	return nil
+}
+
+// Parses a comma-separated list of key=value pairs.
+func parseOptions(s string) (map[string]string, error) {
+	toReturn := make(map[string]string)
+	if strings.TrimSpace(s) == "" {
+		return toReturn, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, found := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !found || (key == "") {
+			return nil, fmt.Errorf("Invalid provider option %q: expected "+
+				"key=value", pair)
+		}
+		toReturn[key] = strings.TrimSpace(value)
+	}
+	return toReturn, nil
+}
+
+// Enables the configured execution provider in the given session options.
+// If the provider can't be enabled, a warning is logged and the session will
+// run on the CPU instead. Either way, a line reporting the provider in use is
+// logged to stderr, so it doesn't mix with any machine-readable output on
+// stdout. Returns the name of the provider that was actually enabled, or an
+// error only if the configuration is invalid.
+func (c *Config) Apply(options *ort.SessionOptions) (string, error) {
+	e := c.Validate()
+	if e != nil {
+		return "", e
+	}
+	used := c.Name
+	if c.Name != "cpu" {
+		e = c.appendProvider(options)
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "Unable to enable the %s execution "+
+				"provider, falling back to the CPU: %s\n", c.Name, e)
+			used = "cpu"
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Using the %s execution provider\n", used)
+	return used, nil
+}
+
+// Appends the configured (non-CPU) provider to the session options.
+func (c *Config) appendProvider(options *ort.SessionOptions) error {
+	providerOptions, e := parseOptions(c.Options)
+	if e != nil {
+		return e
+	}
+	switch c.Name {
+	case "coreml":
+		return options.AppendExecutionProviderCoreMLV2(providerOptions)
+	case "cuda":
+		cudaOptions, e := ort.NewCUDAProviderOptions()
+		if e != nil {
+			return fmt.Errorf("Error creating CUDA options: %w", e)
+		}
+		defer cudaOptions.Destroy()
+		e = cudaOptions.Update(providerOptions)
+		if e != nil {
+			return fmt.Errorf("Error setting CUDA options: %w", e)
+		}
+		return options.AppendExecutionProviderCUDA(cudaOptions)
+	case "tensorrt":
+		tensorRTOptions, e := ort.NewTensorRTProviderOptions()
+		if e != nil {
+			return fmt.Errorf("Error creating TensorRT options: %w", e)
+		}
+		defer tensorRTOptions.Destroy()
+		e = tensorRTOptions.Update(providerOptions)
+		if e != nil {
+			return fmt.Errorf("Error setting TensorRT options: %w", e)
+		}
+		return options.AppendExecutionProviderTensorRT(tensorRTOptions)
+	case "openvino":
+		return options.AppendExecutionProviderOpenVINO(providerOptions)
+	case "directml":
+		deviceID := 0
+		if s, ok := providerOptions["device_id"]; ok {
+			deviceID, e = strconv.Atoi(s)
+			if e != nil {
+				return fmt.Errorf("Invalid DirectML device_id %q: %w", s, e)
+			}
+		}
+		return options.AppendExecutionProviderDirectML(deviceID)
+	}
+	return fmt.Errorf("Unknown execution provider %q", c.Name)
+}
+
+// Creates new session options with the configured execution provider
+// enabled, as described for Apply. The caller must destroy the returned
+// options once the session has been created. onnxruntime must already be
+// initialized.
+func (c *Config) NewSessionOptions() (*ort.SessionOptions, error) {
+	options, e := ort.NewSessionOptions()
+	if e != nil {
+		return nil, fmt.Errorf("Error creating session options: %w", e)
+	}
+	_, e = c.Apply(options)
+	if e != nil {
+		options.Destroy()
+		return nil, e
+	}
+	return options, nil
+}
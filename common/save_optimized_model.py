@@ -0,0 +1,40 @@
+# This script saves a copy of an .onnx network after onnxruntime's graph
+# optimizations have been applied, for use with the -optimized_model flag
+# accepted by the examples. Loading the optimized copy skips the optimization
+# step, which reduces the time it takes to create a session for large networks.
+#
+# See the description of the common/sessionopts package in the top-level
+# README for why this is a python script.
+#
+# Note that networks optimized at the "all" level may contain nodes specific
+# to the hardware and execution provider they were optimized for. Use the
+# "extended" level if the optimized copy will be used on other machines.
+import argparse
+import onnxruntime
+
+LEVELS = {
+    "disable": onnxruntime.GraphOptimizationLevel.ORT_DISABLE_ALL,
+    "basic": onnxruntime.GraphOptimizationLevel.ORT_ENABLE_BASIC,
+    "extended": onnxruntime.GraphOptimizationLevel.ORT_ENABLE_EXTENDED,
+    "all": onnxruntime.GraphOptimizationLevel.ORT_ENABLE_ALL,
+}
+
+def main():
+    parser = argparse.ArgumentParser(description="Saves an optimized copy " +
+        "of an .onnx network.")
+    parser.add_argument("input", help="The .onnx network to optimize.")
+    parser.add_argument("output", help="The path to save the optimized " +
+        "network to. Pass this path to the examples' -optimized_model flag.")
+    parser.add_argument("--level", default="all", choices=LEVELS.keys(),
+        help="The graph optimization level. Defaults to \"all\".")
+    args = parser.parse_args()
+    options = onnxruntime.SessionOptions()
+    options.graph_optimization_level = LEVELS[args.level]
+    options.optimized_model_filepath = args.output
+    # Creating the session is enough to optimize and save the network.
+    onnxruntime.InferenceSession(args.input, options,
+        providers=["CPUExecutionProvider"])
+    print("Saved the optimized network to " + args.output)
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,206 @@
+// Package sessionopts implements the command-line flags shared by the
+// examples for tuning onnxruntime sessions: the execution provider (see the
+// provider package), thread counts, graph optimization level, execution
+// mode, memory settings, and loading a previously optimized copy of the
+// network to reduce startup time. The optimized copy can't be saved from Go,
+// since onnxruntime_go doesn't wrap SetOptimizedModelFilePath, so it must be
+// created using common/save_optimized_model.py.
+package sessionopts
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	ort "github.com/yalue/onnxruntime_go"
+	"github.com/yalue/onnxruntime_go_examples/common/provider"
+)
+
+// Holds the session settings from the command line.
+type Config struct {
+	Provider *provider.Config
+	// The number of threads used to parallelize the execution within nodes,
+	// and between nodes (only in parallel execution mode). If zero,
+	// onnxruntime chooses the number of threads.
+	IntraOpThreads, InterOpThreads int
+	// One of "disable", "basic", "extended" or "all".
+	OptimizationLevel string
+	// Either "sequential" or "parallel".
+	ExecutionMode string
+	MemPattern    bool
+	CPUMemArena   bool
+	// If non-empty, the path to an optimized copy of the network, which is
+	// loaded instead of the original if it exists and is up to date.
+	OptimizedModelPath string
+}
+
+// Registers the session flags, including the provider package's flags, with
+// the flag package, and returns the Config that will hold their values after
+// flag.Parse() is called.
+func AddFlags() *Config {
+	c := &Config{
+		Provider: provider.AddFlags(),
+	}
+	flag.IntVar(&c.IntraOpThreads, "intra_op_threads", 0,
+		"The number of threads used to run each node of the network. If 0, "+
+			"onnxruntime chooses a default based on the number of cores.")
+	flag.IntVar(&c.InterOpThreads, "inter_op_threads", 0,
+		"The number of threads used to run independent nodes concurrently "+
+			"with -execution_mode parallel. If 0, onnxruntime chooses a "+
+			"default.")
+	flag.StringVar(&c.OptimizationLevel, "graph_optimization", "all",
+		"The graph optimizations applied when loading the network. Must be "+
+			"\"disable\", \"basic\", \"extended\" or \"all\".")
+	flag.StringVar(&c.ExecutionMode, "execution_mode", "sequential",
+		"Whether the network's nodes are run \"sequential\" or "+
+			"\"parallel\". Parallel mode may help networks with many "+
+			"independent branches.")
+	flag.BoolVar(&c.MemPattern, "mem_pattern", true,
+		"Whether onnxruntime preallocates memory based on the allocation "+
+			"pattern of previous runs. Disable this for inputs whose shape "+
+			"changes between runs.")
+	flag.BoolVar(&c.CPUMemArena, "cpu_mem_arena", true,
+		"Whether onnxruntime uses a memory arena for CPU allocations. "+
+			"Disabling it reduces memory usage at some cost in speed.")
+	flag.StringVar(&c.OptimizedModelPath, "optimized_model", "",
+		"If set, and this file exists and is newer than the network, it's "+
+			"loaded instead of the network, with graph optimizations "+
+			"disabled since it's already optimized.")
+	return c
+}
+
+// Returns the onnxruntime graph optimization level with the given name.
+func parseOptimizationLevel(name string) (ort.GraphOptimizationLevel, error) {
+	switch name {
+	case "disable":
+		return ort.GraphOptimizationLevelDisableAll, nil
+	case "basic":
+		return ort.GraphOptimizationLevelEnableBasic, nil
+	case "extended":
+		return ort.GraphOptimizationLevelEnableExtended, nil
+	case "all":
+		return ort.GraphOptimizationLevelEnableAll, nil
+	}
+	return ort.GraphOptimizationLevelEnableAll, fmt.Errorf("Invalid graph "+
+		"optimization level %q. Must be disable, basic, extended or all",
+		name)
+}
+
+// Returns the onnxruntime execution mode with the given name.
+func parseExecutionMode(name string) (ort.ExecutionMode, error) {
+	switch name {
+	case "sequential":
+		return ort.ExecutionModeSequential, nil
+	case "parallel":
+		return ort.ExecutionModeParallel, nil
+	}
+	return ort.ExecutionModeSequential, fmt.Errorf("Invalid execution mode "+
+		"%q. Must be sequential or parallel", name)
+}
+
+// Returns an error if any of the settings are invalid. Doesn't require
+// onnxruntime to be initialized, so this can be called immediately after
+// parsing flags.
+func (c *Config) Validate() error {
+	if (c.IntraOpThreads < 0) || (c.InterOpThreads < 0) {
+		return fmt.Errorf("Thread counts can't be negative")
+	}
+	_, e := parseOptimizationLevel(c.OptimizationLevel)
+	if e != nil {
+		return e
+	}
+	_, e = parseExecutionMode(c.ExecutionMode)
+	if e != nil {
+		return e
+	}
+	return c.Provider.Validate()
+}
+
+// Returns true if the optimized model exists and was modified after the
+// original network, so it isn't stale.
+func (c *Config) useOptimizedModel(modelPath string) bool {
+	if c.OptimizedModelPath == "" {
+		return false
+	}
+	optimized, e := os.Stat(c.OptimizedModelPath)
+	if e != nil {
+		return false
+	}
+	original, e := os.Stat(modelPath)
+	if e != nil {
+		return false
+	}
+	return !optimized.ModTime().Before(original.ModTime())
+}
+
+// Creates new session options with all of the configured settings, for
+// loading the network at modelPath. Returns the options along with the path
+// that should actually be loaded, which is the optimized model if one is
+// configured and up to date. The caller must destroy the returned options
+// once the session has been created. onnxruntime must already be
+// initialized.
+func (c *Config) NewSessionOptions(modelPath string) (*ort.SessionOptions,
+	string, error) {
+	e := c.Validate()
+	if e != nil {
+		return nil, "", e
+	}
+	level, _ := parseOptimizationLevel(c.OptimizationLevel)
+	mode, _ := parseExecutionMode(c.ExecutionMode)
+	pathToLoad := modelPath
+	if c.useOptimizedModel(modelPath) {
+		pathToLoad = c.OptimizedModelPath
+		// Optimizing it again would only slow down loading it.
+		level = ort.GraphOptimizationLevelDisableAll
+		fmt.Fprintf(os.Stderr, "Loading the optimized network from %s\n",
+			pathToLoad)
+	} else if c.OptimizedModelPath != "" {
+		fmt.Fprintf(os.Stderr, "%s is missing or older than %s; loading "+
+			"the original network\n", c.OptimizedModelPath, modelPath)
+	}
+
+	options, e := c.Provider.NewSessionOptions()
+	if e != nil {
+		return nil, "", e
+	}
+	e = c.apply(options, level, mode)
+	if e != nil {
+		options.Destroy()
+		return nil, "", e
+	}
+	return options, pathToLoad, nil
+}
+
+// Applies the settings other than the execution provider to the options.
+func (c *Config) apply(options *ort.SessionOptions,
+	level ort.GraphOptimizationLevel, mode ort.ExecutionMode) error {
+	if c.IntraOpThreads > 0 {
+		e := options.SetIntraOpNumThreads(c.IntraOpThreads)
+		if e != nil {
+			return fmt.Errorf("Error setting intra-op threads: %w", e)
+		}
+	}
+	if c.InterOpThreads > 0 {
+		e := options.SetInterOpNumThreads(c.InterOpThreads)
+		if e != nil {
+			return fmt.Errorf("Error setting inter-op threads: %w", e)
+		}
+	}
+	e := options.SetGraphOptimizationLevel(level)
+	if e != nil {
+		return fmt.Errorf("Error setting graph optimization level: %w", e)
+	}
+	e = options.SetExecutionMode(mode)
+	if e != nil {
+		return fmt.Errorf("Error setting execution mode: %w", e)
+	}
+	e = options.SetMemPattern(c.MemPattern)
+	if e != nil {
+		return fmt.Errorf("Error setting memory pattern: %w", e)
+	}
+	e = options.SetCpuMemArena(c.CPUMemArena)
+	if e != nil {
+		return fmt.Errorf("Error setting CPU memory arena: %w", e)
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+// This file contains the code for counting detections within polygonal zones
+// and counting tracked objects crossing virtual lines, as configured in a
+// JSON file.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The contents of an analytics configuration file. For example:
+//
+//	{
+//	  "anchor": "bottom_center",
+//	  "zones": [
+//	    {"name": "entrance", "points": [[0, 0], [400, 0], [400, 300], [0, 300]]}
+//	  ],
+//	  "lines": [
+//	    {"name": "door", "start": [100, 500], "end": [600, 500]}
+//	  ]
+//	}
+type analyticsConfig struct {
+	// The point of each box used to determine whether it's within a zone or
+	// has crossed a line. Either "bottom_center" (the default), which
+	// approximates where a person or vehicle touches the ground, or
+	// "center".
+	Anchor string          `json:"anchor"`
+	Zones  []analyticsZone `json:"zones"`
+	Lines  []analyticsLine `json:"lines"`
+}
+
+// A polygonal region, with its vertices given in image coordinates.
+type analyticsZone struct {
+	Name   string       `json:"name"`
+	Points [][2]float32 `json:"points"`
+}
+
+// A virtual line segment in image coordinates. An object crossing the line
+// from the left side to the right side, when looking from Start towards End,
+// is counted as going "in", and the opposite direction is "out".
+type analyticsLine struct {
+	Name  string     `json:"name"`
+	Start [2]float32 `json:"start"`
+	End   [2]float32 `json:"end"`
+}
+
+func loadAnalyticsConfig(path string) (*analyticsConfig, error) {
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return nil, fmt.Errorf("Error reading %s: %w", path, e)
+	}
+	var toReturn analyticsConfig
+	e = json.Unmarshal(data, &toReturn)
+	if e != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", path, e)
+	}
+	switch toReturn.Anchor {
+	case "":
+		toReturn.Anchor = "bottom_center"
+	case "bottom_center", "center":
+	default:
+		return nil, fmt.Errorf("Invalid anchor %q in %s", toReturn.Anchor,
+			path)
+	}
+	if (len(toReturn.Zones) == 0) && (len(toReturn.Lines) == 0) {
+		return nil, fmt.Errorf("%s doesn't define any zones or lines", path)
+	}
+	for _, z := range toReturn.Zones {
+		if len(z.Points) < 3 {
+			return nil, fmt.Errorf("Zone %q in %s has %d points, but needs "+
+				"at least 3", z.Name, path, len(z.Points))
+		}
+	}
+	for _, l := range toReturn.Lines {
+		if l.Start == l.End {
+			return nil, fmt.Errorf("Line %q in %s has the same start and "+
+				"end point", l.Name, path)
+		}
+	}
+	return &toReturn, nil
+}
+
+// Returns the point of the box used for zone and line checks.
+func (c *analyticsConfig) anchorPoint(b *boundingBox) point {
+	if c.Anchor == "center" {
+		return point{(b.x1 + b.x2) / 2, (b.y1 + b.y2) / 2}
+	}
+	return point{(b.x1 + b.x2) / 2, b.y2}
+}
+
+// Returns true if p lies within the polygon, using the even-odd rule.
+func pointInPolygon(p point, polygon [][2]float32) bool {
+	inside := false
+	j := len(polygon) - 1
+	for i := range polygon {
+		a, b := polygon[i], polygon[j]
+		if ((a[1] > p.y) != (b[1] > p.y)) &&
+			(p.x < (b[0]-a[0])*(p.y-a[1])/(b[1]-a[1])+a[0]) {
+			inside = !inside
+		}
+		j = i
+	}
+	return inside
+}
+
+// Returns a positive value if p is to the right of the line from a to b in
+// image coordinates (where Y increases downwards), a negative value if it's
+// to the left, and 0 if it's on the line.
+func lineSide(a, b, p point) float32 {
+	return (b.x-a.x)*(p.y-a.y) - (b.y-a.y)*(p.x-a.x)
+}
+
+// Returns 1 if moving from p0 to p1 crosses the line from the left to the
+// right, -1 if it crosses from the right to the left, or 0 if it doesn't
+// cross the line segment.
+func lineCrossing(l *analyticsLine, p0, p1 point) int {
+	a, b := point{l.Start[0], l.Start[1]}, point{l.End[0], l.End[1]}
+	side0, side1 := lineSide(a, b, p0), lineSide(a, b, p1)
+	// Starting on the line counts as being on the left, so that an object
+	// stopping exactly on the line is only counted once.
+	if (side0 > 0) == (side1 > 0) {
+		return 0
+	}
+	// The movement crosses the infinite line, so check that it crosses
+	// within the segment by checking that a and b are on opposite sides of
+	// the movement.
+	sideA, sideB := lineSide(p0, p1, a), lineSide(p0, p1, b)
+	if ((sideA > 0) && (sideB > 0)) || ((sideA < 0) && (sideB < 0)) {
+		return 0
+	}
+	if side1 > 0 {
+		return 1
+	}
+	return -1
+}
+
+// Tracks whose last position is older than this many frames are forgotten.
+const analyticsTrackMemory = 300
+
+// A tracked object's most recent anchor point.
+type trackPosition struct {
+	p     point
+	frame int
+}
+
+// One line of the analytics output, describing a single frame.
+type analyticsFrame struct {
+	// Frames are numbered starting at 1.
+	Frame     int                  `json:"frame"`
+	ImagePath string               `json:"image_path"`
+	Zones     []zoneFrameCounts    `json:"zones,omitempty"`
+	Lines     []lineFrameCrossings `json:"lines,omitempty"`
+}
+
+// The number of boxes of each class within a zone in a single frame.
+type zoneFrameCounts struct {
+	Name   string         `json:"name"`
+	Counts map[string]int `json:"counts"`
+	Total  int            `json:"total"`
+}
+
+// The number of tracked objects of each class crossing a line in each
+// direction, both during a single frame and since the first frame.
+type lineFrameCrossings struct {
+	Name     string         `json:"name"`
+	In       map[string]int `json:"in"`
+	Out      map[string]int `json:"out"`
+	TotalIn  map[string]int `json:"total_in"`
+	TotalOut map[string]int `json:"total_out"`
+}
+
+// A detectionWriter that writes the per-frame zone counts and line
+// crossings as one JSON object per line. Line crossings are only counted for
+// boxes with track IDs, so configs with lines require -track.
+type analyticsWriter struct {
+	config    *analyticsConfig
+	w         io.WriteCloser
+	encoder   *json.Encoder
+	positions map[int]trackPosition
+	// The cumulative crossings for each line, in the same order as the
+	// config's lines.
+	totalIn, totalOut []map[string]int
+}
+
+func newAnalyticsWriter(config *analyticsConfig,
+	outputPath string) (*analyticsWriter, error) {
+	w, e := openOutputFile(outputPath)
+	if e != nil {
+		return nil, e
+	}
+	toReturn := &analyticsWriter{
+		config:    config,
+		w:         w,
+		encoder:   json.NewEncoder(w),
+		positions: make(map[int]trackPosition),
+		totalIn:   make([]map[string]int, len(config.Lines)),
+		totalOut:  make([]map[string]int, len(config.Lines)),
+	}
+	for i := range config.Lines {
+		toReturn.totalIn[i] = make(map[string]int)
+		toReturn.totalOut[i] = make(map[string]int)
+	}
+	return toReturn, nil
+}
+
+func (a *analyticsWriter) WriteDetections(frame int, imagePath string,
+	imageWidth, imageHeight int, boxes []boundingBox) error {
+	f := &analyticsFrame{
+		Frame:     frame,
+		ImagePath: imagePath,
+	}
+	for _, z := range a.config.Zones {
+		counts := zoneFrameCounts{
+			Name:   z.Name,
+			Counts: make(map[string]int),
+		}
+		for i := range boxes {
+			if pointInPolygon(a.config.anchorPoint(&(boxes[i])), z.Points) {
+				counts.Counts[boxes[i].label]++
+				counts.Total++
+			}
+		}
+		f.Zones = append(f.Zones, counts)
+	}
+
+	for i := range a.config.Lines {
+		f.Lines = append(f.Lines, lineFrameCrossings{
+			Name:     a.config.Lines[i].Name,
+			In:       make(map[string]int),
+			Out:      make(map[string]int),
+			TotalIn:  a.totalIn[i],
+			TotalOut: a.totalOut[i],
+		})
+	}
+	for i := range boxes {
+		b := &(boxes[i])
+		if b.trackID == 0 {
+			continue
+		}
+		current := a.config.anchorPoint(b)
+		previous, ok := a.positions[b.trackID]
+		a.positions[b.trackID] = trackPosition{p: current, frame: frame}
+		if !ok {
+			continue
+		}
+		for j := range a.config.Lines {
+			switch lineCrossing(&(a.config.Lines[j]), previous.p, current) {
+			case 1:
+				f.Lines[j].In[b.label]++
+				a.totalIn[j][b.label]++
+			case -1:
+				f.Lines[j].Out[b.label]++
+				a.totalOut[j][b.label]++
+			}
+		}
+	}
+	for id, p := range a.positions {
+		if (frame - p.frame) > analyticsTrackMemory {
+			delete(a.positions, id)
+		}
+	}
+
+	e := a.encoder.Encode(f)
+	if e != nil {
+		return fmt.Errorf("Error writing analytics: %w", e)
+	}
+	return nil
+}
+
+func (a *analyticsWriter) Close() error {
+	return a.w.Close()
+}
@@ -0,0 +1,381 @@
+package main
+
+// This file contains the code for running detection on many images in a
+// single invocation, reusing the same onnxruntime session for each one.
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Returns true if the path has an extension of an image format we're able to
+// decode.
+func isImagePath(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return true
+	}
+	return false
+}
+
+// Returns a sorted list of the image files found by recursively walking dir
+// (if dir isn't empty) and matching the glob pattern (if it isn't empty).
+// Paths found by both are only included once.
+func findInputImages(dir, pattern string) ([]string, error) {
+	found := make(map[string]bool)
+	if dir != "" {
+		e := filepath.WalkDir(dir, func(path string, entry fs.DirEntry,
+			e error) error {
+			if e != nil {
+				return e
+			}
+			if !entry.IsDir() && isImagePath(path) {
+				found[path] = true
+			}
+			return nil
+		})
+		if e != nil {
+			return nil, fmt.Errorf("Error searching %s: %w", dir, e)
+		}
+	}
+	if pattern != "" {
+		matches, e := filepath.Glob(pattern)
+		if e != nil {
+			return nil, fmt.Errorf("Invalid glob pattern %q: %w", pattern, e)
+		}
+		for _, path := range matches {
+			info, e := os.Stat(path)
+			if (e == nil) && !info.IsDir() {
+				found[path] = true
+			}
+		}
+	}
+	toReturn := make([]string, 0, len(found))
+	for path := range found {
+		toReturn = append(toReturn, path)
+	}
+	sort.Strings(toReturn)
+	return toReturn, nil
+}
+
+// Sorts paths to numbered frames, such as frame_9.jpg and frame_10.jpg, in
+// numerical order. Paths are compared piece by piece, with runs of digits
+// compared by their numerical value rather than lexicographically.
+func sortFramePaths(paths []string) {
+	sort.SliceStable(paths, func(i, j int) bool {
+		return naturalLess(paths[i], paths[j])
+	})
+}
+
+func isDigit(c byte) bool {
+	return (c >= '0') && (c <= '9')
+}
+
+// Returns true if a comes before b in "natural" order, in which embedded
+// numbers are compared numerically.
+func naturalLess(a, b string) bool {
+	for (len(a) > 0) && (len(b) > 0) {
+		if !isDigit(a[0]) || !isDigit(b[0]) {
+			if a[0] != b[0] {
+				return a[0] < b[0]
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		// Compare the runs of digits at the start of each string, ignoring
+		// leading zeros.
+		endA, endB := 0, 0
+		for (endA < len(a)) && isDigit(a[endA]) {
+			endA++
+		}
+		for (endB < len(b)) && isDigit(b[endB]) {
+			endB++
+		}
+		numberA := strings.TrimLeft(a[:endA], "0")
+		numberB := strings.TrimLeft(b[:endB], "0")
+		if len(numberA) != len(numberB) {
+			return len(numberA) < len(numberB)
+		}
+		if numberA != numberB {
+			return numberA < numberB
+		}
+		a, b = a[endA:], b[endB:]
+	}
+	return len(a) < len(b)
+}
+
+// In batch mode, the directory containing every input image. Files written
+// to output directories are named after each image's path relative to this
+// directory, so that images with the same name in different subdirectories
+// of -input_dir don't overwrite each other's outputs. If empty, outputs are
+// named after the image's base name, e.g., for frames of an animation.
+var inputRootDir string
+
+// Returns the deepest directory containing all of the given paths.
+func commonParentDir(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	dir := filepath.Dir(filepath.Clean(paths[0]))
+	for _, path := range paths[1:] {
+		for !isWithinDir(dir, filepath.Clean(path)) {
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				// Not even the root contains both (e.g., one is relative).
+				return ""
+			}
+			dir = parent
+		}
+	}
+	return dir
+}
+
+// Returns true if path is dir or one of its descendants.
+func isWithinDir(dir, path string) bool {
+	rel, e := filepath.Rel(dir, path)
+	if e != nil {
+		return false
+	}
+	return (rel != "..") &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Returns the path, relative to an output directory, of the output for the
+// given image, without the image's extension. This is the image's path
+// relative to inputRootDir, or just its base name if inputRootDir isn't set.
+func outputName(imagePath string) string {
+	name := filepath.Base(imagePath)
+	if (inputRootDir != "") && isWithinDir(inputRootDir, imagePath) {
+		rel, e := filepath.Rel(inputRootDir, imagePath)
+		if e == nil {
+			name = rel
+		}
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// Returns the path in outputDir at which a file for imagePath with the given
+// extension should be saved, as described for outputName, creating any
+// subdirectories needed to hold it.
+func outputFilePath(outputDir, imagePath, ext string) (string, error) {
+	path := filepath.Join(outputDir, outputName(imagePath)+ext)
+	dir := filepath.Dir(path)
+	e := os.MkdirAll(dir, 0755)
+	if e != nil {
+		return "", fmt.Errorf("Error creating %s: %w", dir, e)
+	}
+	return path, nil
+}
+
+// Returns the path at which a modified copy of imagePath, such as an
+// annotated copy, should be saved in outputDir. Images keep their original
+// name and relative path, though formats we can't encode are saved as PNGs.
+func imageOutputPath(outputDir, imagePath string) (string, error) {
+	ext := strings.ToLower(filepath.Ext(imagePath))
+	if (ext != ".png") && (ext != ".jpg") && (ext != ".jpeg") {
+		ext = ".png"
+	} else {
+		ext = filepath.Ext(imagePath)
+	}
+	return outputFilePath(outputDir, imagePath, ext)
+}
+
+// Implemented by each of the outputs that are produced from the images
+// themselves, rather than just the detected boxes. WriteImage is called once
+// per processed image. frame is the image's number in its frameSource, as
+// for detectionWriter.WriteDetections.
+type imageWriter interface {
+	WriteImage(frame int, imagePath string, pic image.Image,
+		boxes []boundingBox) error
+}
+
+// Implemented by imageWriters that should be given all of the boxes detected
+// in each image, rather than only the boxes belonging to tracked objects, when
+// tracking is enabled.
+type untrackedImageWriter interface {
+	usesUntrackedBoxes() bool
+}
+
+// Saves a copy of each image with its boxes drawn on top to a directory.
+type annotatedImageWriter struct {
+	dir string
+}
+
+// Returns an annotatedImageWriter saving images to dir, creating dir if it
+// doesn't exist.
+func newAnnotatedImageWriter(dir string) (*annotatedImageWriter, error) {
+	e := os.MkdirAll(dir, 0755)
+	if e != nil {
+		return nil, fmt.Errorf("Error creating %s: %w", dir, e)
+	}
+	return &annotatedImageWriter{dir: dir}, nil
+}
+
+func (a *annotatedImageWriter) WriteImage(frame int, imagePath string,
+	pic image.Image, boxes []boundingBox) error {
+	path, e := imageOutputPath(a.dir, imagePath)
+	if e == nil {
+		e = saveImage(drawDetections(pic, boxes), path)
+	}
+	if e != nil {
+		return fmt.Errorf("Error saving annotated image: %w", e)
+	}
+	return nil
+}
+
+// Tracks the results of processing a batch of images.
+type batchSummary struct {
+	imagesProcessed    int
+	imagesFailed       int
+	totalDetections    int
+	detectionsPerClass map[string]int
+	elapsed            time.Duration
+}
+
+func newBatchSummary() *batchSummary {
+	return &batchSummary{
+		detectionsPerClass: make(map[string]int),
+	}
+}
+
+// Updates the summary with the boxes detected in a single image.
+func (s *batchSummary) addImage(boxes []boundingBox) {
+	s.imagesProcessed++
+	s.totalDetections += len(boxes)
+	for i := range boxes {
+		s.detectionsPerClass[boxes[i].label]++
+	}
+}
+
+// Prints a human-readable summary to w. Classes are listed in order of
+// decreasing number of detections.
+func (s *batchSummary) Print(w io.Writer) {
+	fmt.Fprintf(w, "Processed %d images (%d failed) in %s\n",
+		s.imagesProcessed, s.imagesFailed, s.elapsed)
+	if s.elapsed > 0 {
+		fmt.Fprintf(w, "Throughput: %.2f images/second\n",
+			float64(s.imagesProcessed)/s.elapsed.Seconds())
+	}
+	fmt.Fprintf(w, "%d total detections\n", s.totalDetections)
+	labels := make([]string, 0, len(s.detectionsPerClass))
+	for label := range s.detectionsPerClass {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		a := s.detectionsPerClass[labels[i]]
+		b := s.detectionsPerClass[labels[j]]
+		if a != b {
+			return a > b
+		}
+		return labels[i] < labels[j]
+	})
+	for _, label := range labels {
+		fmt.Fprintf(w, "  %s: %d\n", label, s.detectionsPerClass[label])
+	}
+}
+
+// Runs detection on each of the images produced by frames, d.imagesPerBatch()
+// images at a time, reporting the results for each one to the given detection
+// writer and to each of the image writers (e.g., to save an annotated copy of
+// each image). Errors with individual images are printed (unless quiet is
+// set) and counted, but don't stop the batch. If objects is non-nil, the
+// images are treated as consecutive frames of a video, and only the boxes
+// belonging to tracked objects are reported, except to untrackedImageWriters,
+// which are given every box. Stops after maxFrames images if maxFrames is
+// positive.
+func processImages(d *detector, frames frameSource, maxFrames int,
+	results detectionWriter, imageWriters []imageWriter, objects *tracker,
+	quiet bool) *batchSummary {
+	summary := newBatchSummary()
+	logError := func(format string, args ...any) {
+		summary.imagesFailed++
+		if !quiet {
+			fmt.Printf(format, args...)
+		}
+	}
+
+	startTime := time.Now()
+	batchSize := d.imagesPerBatch()
+	batchPaths := make([]string, 0, batchSize)
+	batchPics := make([]image.Image, 0, batchSize)
+	batchFrames := make([]int, 0, batchSize)
+
+	// Runs the network on the images accumulated so far, and reports the
+	// results for each of them.
+	flushBatch := func() {
+		if len(batchPics) == 0 {
+			return
+		}
+		allBoxes, transforms, e := d.detectImages(batchPics)
+		if e != nil {
+			d.timing.Discard()
+			for _, path := range batchPaths {
+				logError("Error processing %s: %s\n", path, e)
+			}
+			batchPaths = batchPaths[:0]
+			batchPics = batchPics[:0]
+			batchFrames = batchFrames[:0]
+			return
+		}
+		d.timing.Finish(len(batchPics))
+		for i, path := range batchPaths {
+			untracked := allBoxes[i]
+			boxes := untracked
+			if objects != nil {
+				boxes = objects.Update(untracked)
+			}
+			summary.addImage(boxes)
+			e = results.WriteDetections(batchFrames[i], path,
+				transforms[i].originalWidth, transforms[i].originalHeight,
+				boxes)
+			if e != nil {
+				logError("Error writing detections for %s: %s\n", path, e)
+				continue
+			}
+			for _, w := range imageWriters {
+				toWrite := boxes
+				if u, ok := w.(untrackedImageWriter); ok &&
+					u.usesUntrackedBoxes() {
+					toWrite = untracked
+				}
+				e = w.WriteImage(batchFrames[i], path, batchPics[i],
+					toWrite)
+				if e != nil {
+					logError("Error processing %s: %s\n", path, e)
+					break
+				}
+			}
+		}
+		batchPaths = batchPaths[:0]
+		batchPics = batchPics[:0]
+		batchFrames = batchFrames[:0]
+	}
+
+	for frame := 0; (maxFrames <= 0) || (frame < maxFrames); frame++ {
+		path, pic, e := frames.NextFrame()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			logError("Error loading %s: %s\n", path, e)
+			continue
+		}
+		batchPaths = append(batchPaths, path)
+		batchPics = append(batchPics, pic)
+		batchFrames = append(batchFrames, frames.FrameNumber())
+		if len(batchPics) == batchSize {
+			flushBatch()
+		}
+	}
+	// The final batch may be smaller than batchSize.
+	flushBatch()
+	summary.elapsed = time.Since(startTime)
+	return summary
+}
@@ -0,0 +1,138 @@
+package main
+
+// This file contains the code for saving each detected object as its own
+// cropped image, for example to build a dataset for training a classifier.
+
+import (
+	"encoding/csv"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Saves each box as a separate cropped PNG image in a directory, along with
+// an index.csv file listing every crop. The crop file names in the index are
+// relative to the directory, so it can be moved along with the crops.
+type cropWriter struct {
+	dir string
+	// The fraction of each box's width and height added to each side of the
+	// box before cropping.
+	padding float64
+	// Boxes narrower or shorter than this, in pixels, are skipped.
+	minSize int
+	index   *os.File
+	csv     *csv.Writer
+}
+
+// Returns a cropWriter saving crops to dir, creating dir if it doesn't exist.
+func newCropWriter(dir string, padding float64,
+	minSize int) (*cropWriter, error) {
+	if padding < 0 {
+		return nil, fmt.Errorf("Invalid crop padding: %f", padding)
+	}
+	e := os.MkdirAll(dir, 0755)
+	if e != nil {
+		return nil, fmt.Errorf("Error creating %s: %w", dir, e)
+	}
+	indexPath := filepath.Join(dir, "index.csv")
+	index, e := os.Create(indexPath)
+	if e != nil {
+		return nil, fmt.Errorf("Error creating %s: %w", indexPath, e)
+	}
+	toReturn := &cropWriter{
+		dir:     dir,
+		padding: padding,
+		minSize: minSize,
+		index:   index,
+		csv:     csv.NewWriter(index),
+	}
+	e = toReturn.csv.Write([]string{"crop_file", "image_path", "class_id",
+		"label", "confidence", "x1", "y1", "x2", "y2"})
+	if e != nil {
+		index.Close()
+		return nil, fmt.Errorf("Error writing %s: %w", indexPath, e)
+	}
+	return toReturn, nil
+}
+
+// Returns the region of the image to crop for the given box: the box
+// expanded by the padding on each side, and clipped to the image's bounds.
+// The returned rectangle is relative to the image's top-left corner.
+func (c *cropWriter) cropRect(box *boundingBox, imageWidth,
+	imageHeight int) image.Rectangle {
+	padX := float64(box.x2-box.x1) * c.padding
+	padY := float64(box.y2-box.y1) * c.padding
+	r := image.Rect(int(float64(box.x1)-padX), int(float64(box.y1)-padY),
+		int(float64(box.x2)+padX), int(float64(box.y2)+padY))
+	return r.Intersect(image.Rect(0, 0, imageWidth, imageHeight))
+}
+
+// Returns a file name for a crop, containing the class's label and the box's
+// confidence, followed by the original image's name and the box's index in
+// it to keep the name unique. In batch mode, the name is in the same
+// subdirectory as the image's path relative to inputRootDir (see outputName).
+func cropFileName(imagePath string, index int, box *boundingBox) string {
+	label := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		return r
+	}, box.label)
+	name := outputName(imagePath)
+	return filepath.Join(filepath.Dir(name), fmt.Sprintf("%s_%.2f_%s_%d.png",
+		label, box.confidence, filepath.Base(name), index))
+}
+
+func (c *cropWriter) WriteImage(frame int, imagePath string,
+	pic image.Image, boxes []boundingBox) error {
+	bounds := pic.Bounds()
+	for i := range boxes {
+		box := &(boxes[i])
+		if (int(box.x2-box.x1) < c.minSize) ||
+			(int(box.y2-box.y1) < c.minSize) {
+			continue
+		}
+		r := c.cropRect(box, bounds.Dx(), bounds.Dy())
+		if r.Empty() {
+			continue
+		}
+		cropName := cropFileName(imagePath, i, box)
+		cropPath := filepath.Join(c.dir, cropName)
+		e := os.MkdirAll(filepath.Dir(cropPath), 0755)
+		if e == nil {
+			e = saveImage(cropImage(pic, r.Add(bounds.Min)), cropPath)
+		}
+		if e != nil {
+			return fmt.Errorf("Error saving crop: %w", e)
+		}
+		e = c.csv.Write([]string{
+			cropName,
+			imagePath,
+			strconv.Itoa(box.classID),
+			box.label,
+			strconv.FormatFloat(float64(box.confidence), 'f', 4, 32),
+			strconv.Itoa(r.Min.X),
+			strconv.Itoa(r.Min.Y),
+			strconv.Itoa(r.Max.X),
+			strconv.Itoa(r.Max.Y),
+		})
+		if e != nil {
+			return fmt.Errorf("Error writing crop index: %w", e)
+		}
+	}
+	return nil
+}
+
+func (c *cropWriter) Close() error {
+	c.csv.Flush()
+	e := c.csv.Error()
+	if e != nil {
+		c.index.Close()
+		return fmt.Errorf("Error writing crop index: %w", e)
+	}
+	return c.index.Close()
+}
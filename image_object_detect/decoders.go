@@ -0,0 +1,229 @@
+package main
+
+// This file contains the decoders used to convert the output of different
+// generations of YOLO detection networks into bounding boxes.
+
+import (
+	"fmt"
+	"sort"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// Converts the "output0" tensor of a detection network into a list of
+// bounding boxes in the original image's coordinates, sorted in order of
+// decreasing confidence. Each implementation handles the output layout of a
+// different generation of YOLO networks.
+type outputDecoder interface {
+	// Returns the name used to select the decoder with the -decoder flag.
+	Name() string
+	// Decodes the output for a single image. The output's shape will have a
+	// batch size of 1, and the transform must be the one returned by
+	// prepareInput.
+	Decode(output []float32, outputShape ort.Shape, transform *inputTransform,
+		opts *DetectionOptions) ([]boundingBox, error)
+	// Returns the number of classes predicted by a network with the given
+	// output shape, where numExtra is the number of additional per-box
+	// values (e.g., mask coefficients) output alongside each box. Returns -1
+	// if the number of classes can't be determined from the shape.
+	NumClasses(outputShape ort.Shape, numExtra int) int
+}
+
+// Decodes the output of YOLOv5 networks, with shape 1 x (number of anchors) x
+// (5 + number of classes). Unlike later versions, each anchor's values are
+// contiguous: its center X, center Y, width and height, followed by an
+// objectness score and the class probabilities. A box's confidence is its
+// objectness multiplied by its class probability.
+type yoloV5Decoder struct{}
+
+func (d yoloV5Decoder) Name() string {
+	return "v5"
+}
+
+func (d yoloV5Decoder) NumClasses(outputShape ort.Shape, numExtra int) int {
+	if len(outputShape) != 3 {
+		return -1
+	}
+	return int(outputShape[2]) - 5 - numExtra
+}
+
+func (d yoloV5Decoder) Decode(output []float32, outputShape ort.Shape,
+	transform *inputTransform, opts *DetectionOptions) ([]boundingBox, error) {
+	if opts == nil {
+		opts = DefaultDetectionOptions()
+	}
+	if (len(outputShape) != 3) || (outputShape[2] <= 5) {
+		return nil, fmt.Errorf("Invalid YOLOv5 output shape: %s", outputShape)
+	}
+	numAnchors := int(outputShape[1])
+	rowSize := int(outputShape[2])
+	numClasses := rowSize - 5
+	if len(output) < (numAnchors * rowSize) {
+		return nil, fmt.Errorf("Output only contains %d floats, expected "+
+			"at least %d for shape %s", len(output), numAnchors*rowSize,
+			outputShape)
+	}
+	candidates := make([]boundingBox, 0, numAnchors)
+	for idx := 0; idx < numAnchors; idx++ {
+		row := output[idx*rowSize : (idx+1)*rowSize]
+		objectness := row[4]
+		// The confidence can't exceed the objectness, so skip the class
+		// probabilities entirely for most anchors.
+		if objectness < opts.ConfidenceThreshold {
+			continue
+		}
+		probability := float32(-1e9)
+		classID := -1
+		for col := 0; col < numClasses; col++ {
+			if (opts.AllowedClasses != nil) && !opts.AllowedClasses[col] {
+				continue
+			}
+			if row[5+col] > probability {
+				probability = row[5+col]
+				classID = col
+			}
+		}
+		if classID < 0 {
+			continue
+		}
+		probability *= objectness
+		if probability < opts.ConfidenceThreshold {
+			continue
+		}
+		xc, yc, w, h := row[0], row[1], row[2], row[3]
+		x1, y1 := transform.toOriginal(xc-w/2, yc-h/2)
+		x2, y2 := transform.toOriginal(xc+w/2, yc+h/2)
+		candidates = append(candidates, boundingBox{
+			label:      classLabel(classID),
+			classID:    classID,
+			confidence: probability,
+			x1:         x1,
+			y1:         y1,
+			x2:         x2,
+			y2:         y2,
+		})
+	}
+	return nonMaxSuppression(candidates, opts), nil
+}
+
+// Decodes the output of YOLOv8 and YOLO11 networks, which share the same
+// layout. See processOutput.
+type yoloV8Decoder struct{}
+
+func (d yoloV8Decoder) Name() string {
+	return "v8"
+}
+
+func (d yoloV8Decoder) NumClasses(outputShape ort.Shape, numExtra int) int {
+	if len(outputShape) != 3 {
+		return -1
+	}
+	return int(outputShape[1]) - 4 - numExtra
+}
+
+func (d yoloV8Decoder) Decode(output []float32, outputShape ort.Shape,
+	transform *inputTransform, opts *DetectionOptions) ([]boundingBox, error) {
+	return processOutput(output, outputShape, transform, opts)
+}
+
+// Decodes the output of NMS-free YOLOv10 networks, with shape 1 x (maximum
+// number of boxes, usually 300) x 6. Each row holds a box's top-left X and Y,
+// bottom-right X and Y, confidence, and class ID. The network has already
+// removed overlapping boxes, so no NMS is performed; the NMS settings in the
+// DetectionOptions are ignored.
+type yoloV10Decoder struct{}
+
+func (d yoloV10Decoder) Name() string {
+	return "v10"
+}
+
+// The class IDs are output as values rather than rows, so the number of
+// classes is unknown.
+func (d yoloV10Decoder) NumClasses(outputShape ort.Shape, numExtra int) int {
+	return -1
+}
+
+func (d yoloV10Decoder) Decode(output []float32, outputShape ort.Shape,
+	transform *inputTransform, opts *DetectionOptions) ([]boundingBox, error) {
+	if opts == nil {
+		opts = DefaultDetectionOptions()
+	}
+	if (len(outputShape) != 3) || (outputShape[2] != 6) {
+		return nil, fmt.Errorf("Invalid YOLOv10 output shape: %s",
+			outputShape)
+	}
+	numBoxes := int(outputShape[1])
+	if len(output) < (numBoxes * 6) {
+		return nil, fmt.Errorf("Output only contains %d floats, expected "+
+			"at least %d for shape %s", len(output), numBoxes*6, outputShape)
+	}
+	toReturn := make([]boundingBox, 0, numBoxes)
+	for idx := 0; idx < numBoxes; idx++ {
+		row := output[idx*6 : (idx+1)*6]
+		probability := row[4]
+		classID := int(row[5])
+		if probability < opts.ConfidenceThreshold {
+			continue
+		}
+		if (opts.AllowedClasses != nil) && !opts.AllowedClasses[classID] {
+			continue
+		}
+		x1, y1 := transform.toOriginal(row[0], row[1])
+		x2, y2 := transform.toOriginal(row[2], row[3])
+		toReturn = append(toReturn, boundingBox{
+			label:      classLabel(classID),
+			classID:    classID,
+			confidence: probability,
+			x1:         x1,
+			y1:         y1,
+			x2:         x2,
+			y2:         y2,
+		})
+	}
+	// The network usually outputs boxes in order of decreasing confidence
+	// already, but we don't rely on it.
+	sort.SliceStable(toReturn, func(i, j int) bool {
+		return toReturn[i].confidence > toReturn[j].confidence
+	})
+	if (opts.MaxDetections > 0) && (len(toReturn) > opts.MaxDetections) {
+		toReturn = toReturn[:opts.MaxDetections]
+	}
+	return toReturn, nil
+}
+
+// Returns the decoder with the given name, as accepted by the -decoder flag.
+// "v11" is accepted as an alias for the YOLOv8 decoder.
+func getDecoder(name string) (outputDecoder, error) {
+	switch name {
+	case "v5":
+		return yoloV5Decoder{}, nil
+	case "v8", "v11":
+		return yoloV8Decoder{}, nil
+	case "v10":
+		return yoloV10Decoder{}, nil
+	}
+	return nil, fmt.Errorf("Unknown decoder %q", name)
+}
+
+// Chooses a decoder based on the shape of a detection network's output:
+//   - N x 6, with at most 1000 rows: an NMS-free YOLOv10 network
+//   - (4 + classes) x (anchors), with fewer rows than columns: YOLOv8/YOLO11
+//   - (anchors) x (5 + classes), with more rows than columns: YOLOv5
+func detectDecoder(outputShape ort.Shape) (outputDecoder, error) {
+	if len(outputShape) != 3 {
+		return nil, fmt.Errorf("Unable to determine the decoder for output "+
+			"shape %s: expected 3 dimensions", outputShape)
+	}
+	rows, columns := outputShape[1], outputShape[2]
+	if (columns == 6) && (rows <= 1000) {
+		return yoloV10Decoder{}, nil
+	}
+	if rows < columns {
+		return yoloV8Decoder{}, nil
+	}
+	if rows > columns {
+		return yoloV5Decoder{}, nil
+	}
+	return nil, fmt.Errorf("Unable to determine the decoder for output "+
+		"shape %s; use -decoder to choose one", outputShape)
+}
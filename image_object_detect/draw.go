@@ -0,0 +1,220 @@
+package main
+
+// This file contains the code for drawing detected bounding boxes onto a copy
+// of the input image, so the results can be inspected visually.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// The colors used for the boxes of each class, indexed by class ID modulo the
+// palette's length. This is the same palette used by the Ultralytics python
+// library, so the annotated images should look familiar to YOLO users.
+var boxPalette = []color.RGBA{
+	{0xff, 0x38, 0x38, 0xff}, {0xff, 0x9d, 0x97, 0xff},
+	{0xff, 0x70, 0x1f, 0xff}, {0xff, 0xb2, 0x1d, 0xff},
+	{0xcf, 0xd2, 0x31, 0xff}, {0x48, 0xf9, 0x0a, 0xff},
+	{0x92, 0xcc, 0x17, 0xff}, {0x3d, 0xdb, 0x86, 0xff},
+	{0x1a, 0x93, 0x34, 0xff}, {0x00, 0xd4, 0xbb, 0xff},
+	{0x2c, 0x99, 0xa8, 0xff}, {0x00, 0xc2, 0xff, 0xff},
+	{0x34, 0x45, 0x93, 0xff}, {0x64, 0x73, 0xff, 0xff},
+	{0x00, 0x18, 0xec, 0xff}, {0x84, 0x38, 0xff, 0xff},
+	{0x52, 0x00, 0x85, 0xff}, {0xcb, 0x38, 0xff, 0xff},
+	{0xff, 0x95, 0xc8, 0xff}, {0xff, 0x37, 0xc7, 0xff},
+}
+
+// The thickness, in pixels, of the outlines drawn around each box.
+const boxLineWidth = 3
+
+// Returns the color used to draw boxes with the given class ID.
+func classColor(classID int) color.RGBA {
+	if classID < 0 {
+		classID = -classID
+	}
+	return boxPalette[classID%len(boxPalette)]
+}
+
+// Returns black or white, whichever is more legible on top of c.
+func textColor(c color.RGBA) color.Color {
+	luma := 0.299*float32(c.R) + 0.587*float32(c.G) + 0.114*float32(c.B)
+	if luma > 150 {
+		return color.Black
+	}
+	return color.White
+}
+
+// Draws a rectangular outline with the given thickness onto dst. The outline
+// is drawn inside r, and is clipped to dst's bounds.
+func drawRectOutline(dst draw.Image, r image.Rectangle, c color.Color,
+	thickness int) {
+	r = r.Intersect(dst.Bounds())
+	if r.Empty() {
+		return
+	}
+	src := image.NewUniform(c)
+	sides := []image.Rectangle{
+		image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+thickness),
+		image.Rect(r.Min.X, r.Max.Y-thickness, r.Max.X, r.Max.Y),
+		image.Rect(r.Min.X, r.Min.Y, r.Min.X+thickness, r.Max.Y),
+		image.Rect(r.Max.X-thickness, r.Min.Y, r.Max.X, r.Max.Y),
+	}
+	for _, side := range sides {
+		draw.Draw(dst, side.Intersect(r), src, image.Point{}, draw.Src)
+	}
+}
+
+// Draws a line of the given thickness from (x0, y0) to (x1, y1).
+func drawLine(dst draw.Image, x0, y0, x1, y1 int, c color.Color,
+	thickness int) {
+	src := image.NewUniform(c)
+	dx, dy := x1-x0, y1-y0
+	steps := max(abs(dx), abs(dy), 1)
+	for i := 0; i <= steps; i++ {
+		x := x0 + dx*i/steps
+		y := y0 + dy*i/steps
+		r := image.Rect(x-thickness/2, y-thickness/2,
+			x-thickness/2+thickness, y-thickness/2+thickness)
+		draw.Draw(dst, r, src, image.Point{}, draw.Src)
+	}
+}
+
+// Draws a filled circle centered at (cx, cy).
+func drawDot(dst draw.Image, cx, cy, radius int, c color.Color) {
+	for y := -radius; y <= radius; y++ {
+		for x := -radius; x <= radius; x++ {
+			if (x*x + y*y) <= (radius * radius) {
+				dst.Set(cx+x, cy+y, c)
+			}
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Draws text on a filled background just above the top-left corner of r. If
+// there's no room above r, the label is drawn just inside it instead.
+func drawLabel(dst draw.Image, r image.Rectangle, text string,
+	background color.RGBA) {
+	face := basicfont.Face7x13
+	metrics := face.Metrics()
+	textWidth := font.MeasureString(face, text).Ceil()
+	textHeight := metrics.Height.Ceil()
+	labelRect := image.Rect(r.Min.X, r.Min.Y-textHeight-2,
+		r.Min.X+textWidth+4, r.Min.Y)
+	if labelRect.Min.Y < dst.Bounds().Min.Y {
+		labelRect = labelRect.Add(image.Pt(0, textHeight+2))
+	}
+	draw.Draw(dst, labelRect, image.NewUniform(background), image.Point{},
+		draw.Src)
+	drawer := &font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(textColor(background)),
+		Face: face,
+		Dot: fixed.P(labelRect.Min.X+2,
+			labelRect.Min.Y+1+metrics.Ascent.Ceil()),
+	}
+	drawer.DrawString(text)
+}
+
+// The opacity of the class colors blended over instance masks.
+const maskOpacity = 0x80
+
+// Blends each box's mask, if it has one, on top of dst using the box's class
+// color. Does nothing for boxes without masks.
+func drawMasks(dst *image.RGBA, boxes []boundingBox) {
+	offset := dst.Bounds().Min
+	for i := range boxes {
+		box := &(boxes[i])
+		if box.mask == nil {
+			continue
+		}
+		c := classColor(box.classID)
+		c = color.RGBA{
+			R: uint8(uint32(c.R) * maskOpacity / 0xff),
+			G: uint8(uint32(c.G) * maskOpacity / 0xff),
+			B: uint8(uint32(c.B) * maskOpacity / 0xff),
+			A: maskOpacity,
+		}
+		r := box.mask.Bounds().Add(offset)
+		draw.DrawMask(dst, r, image.NewUniform(c), image.Point{}, box.mask,
+			box.mask.Bounds().Min, draw.Over)
+	}
+}
+
+// Returns a copy of pic with the mask of each of the given boxes overlaid in
+// its class's color.
+func drawMaskOverlay(pic image.Image, boxes []boundingBox) *image.RGBA {
+	bounds := pic.Bounds()
+	toReturn := image.NewRGBA(bounds)
+	draw.Draw(toReturn, bounds, pic, bounds.Min, draw.Src)
+	drawMasks(toReturn, boxes)
+	return toReturn
+}
+
+// Returns a copy of pic with each of the given boxes drawn on top of it,
+// labeled with its class, track ID (if any) and confidence. Any masks,
+// skeletons or rotated boxes are drawn, too.
+func drawDetections(pic image.Image, boxes []boundingBox) *image.RGBA {
+	toReturn := drawMaskOverlay(pic, boxes)
+	bounds := toReturn.Bounds()
+	// Draw the boxes in reverse order so that the most confident boxes, which
+	// come first, end up on top.
+	for i := len(boxes) - 1; i >= 0; i-- {
+		box := &(boxes[i])
+		c := classColor(box.classID)
+		rect := box.toRect().Add(bounds.Min)
+		if box.corners == nil {
+			drawRectOutline(toReturn, rect, c, boxLineWidth)
+		}
+		label := fmt.Sprintf("%s %.2f", box.label, box.confidence)
+		if box.trackID != 0 {
+			label = fmt.Sprintf("%s #%d %.2f", box.label, box.trackID,
+				box.confidence)
+		}
+		drawLabel(toReturn, rect, label, c)
+	}
+	drawSkeletons(toReturn, boxes)
+	drawRotatedBoxes(toReturn, boxes)
+	return toReturn
+}
+
+// Saves the given image to the given path. The format is chosen based on the
+// path's extension; either PNG or JPEG.
+func saveImage(pic image.Image, path string) error {
+	ext := strings.ToLower(filepath.Ext(path))
+	if (ext != ".png") && (ext != ".jpg") && (ext != ".jpeg") {
+		return fmt.Errorf("Unsupported output image format %q (expected "+
+			".png, .jpg, or .jpeg)", ext)
+	}
+	f, e := os.Create(path)
+	if e != nil {
+		return fmt.Errorf("Error creating %s: %w", path, e)
+	}
+	defer f.Close()
+	if ext == ".png" {
+		e = png.Encode(f, pic)
+	} else {
+		e = jpeg.Encode(f, pic, &jpeg.Options{Quality: 90})
+	}
+	if e != nil {
+		return fmt.Errorf("Error encoding %s: %w", path, e)
+	}
+	return nil
+}
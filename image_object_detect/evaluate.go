@@ -0,0 +1,378 @@
+package main
+
+// This file contains the code for measuring detection accuracy against a
+// dataset with COCO-format ground truth annotations, using the same mean
+// average precision (mAP) metrics as pycocotools.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The parts of a COCO annotation file needed for evaluating detections.
+type cocoDataset struct {
+	Images []struct {
+		ID       int    `json:"id"`
+		FileName string `json:"file_name"`
+	} `json:"images"`
+	Annotations []struct {
+		ImageID    int        `json:"image_id"`
+		CategoryID int        `json:"category_id"`
+		BBox       [4]float32 `json:"bbox"`
+		IsCrowd    int        `json:"iscrowd"`
+	} `json:"annotations"`
+	Categories []struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	} `json:"categories"`
+}
+
+func loadCOCODataset(path string) (*cocoDataset, error) {
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return nil, fmt.Errorf("Error reading %s: %w", path, e)
+	}
+	var toReturn cocoDataset
+	e = json.Unmarshal(data, &toReturn)
+	if e != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", path, e)
+	}
+	if len(toReturn.Images) == 0 {
+		return nil, fmt.Errorf("%s doesn't contain any images", path)
+	}
+	return &toReturn, nil
+}
+
+// A ground truth or detected box used during evaluation, in the COCO
+// category space.
+type evalBox struct {
+	imageID    int
+	categoryID int
+	box        boundingBox
+	// Only used for ground truth boxes. Detections matching crowd regions
+	// are ignored rather than counted as false positives.
+	isCrowd bool
+}
+
+// The IoU thresholds at which AP is computed, matching COCO: 0.5 to 0.95 in
+// steps of 0.05.
+var evalIoUThresholds = []float32{
+	0.5, 0.55, 0.6, 0.65, 0.7, 0.75, 0.8, 0.85, 0.9, 0.95,
+}
+
+// COCO only considers the 100 most confident detections of each category in
+// each image. (pycocotools' maxDets limit applies separately to each
+// category, so an image may contribute more than 100 detections in total.)
+const evalMaxDetectionsPerImage = 100
+
+// The number of evenly spaced recall values at which precision is sampled,
+// matching COCO's 101-point interpolation.
+const evalRecallPoints = 101
+
+// The evaluation results for a single category.
+type categoryResult struct {
+	categoryID     int
+	name           string
+	numGroundTruth int
+	// The AP at each of evalIoUThresholds.
+	ap []float64
+	// The interpolated precision at each of the evalRecallPoints recall
+	// values, at an IoU threshold of 0.5.
+	precision50 []float64
+}
+
+// Returns the mean AP over all IoU thresholds.
+func (r *categoryResult) apAll() float64 {
+	sum := 0.0
+	for _, v := range r.ap {
+		sum += v
+	}
+	return sum / float64(len(r.ap))
+}
+
+// The results of evaluating detections against an entire dataset.
+type evaluationResult struct {
+	// Only includes categories with at least one ground truth box.
+	categories      []*categoryResult
+	imagesEvaluated int
+	imagesFailed    int
+}
+
+// Returns the mAP at an IoU threshold of 0.5, and the mAP averaged over IoU
+// thresholds from 0.5 to 0.95, as reported by pycocotools.
+func (r *evaluationResult) meanAP() (float64, float64) {
+	if len(r.categories) == 0 {
+		return 0, 0
+	}
+	var map50, mapAll float64
+	for _, c := range r.categories {
+		map50 += c.ap[0]
+		mapAll += c.apAll()
+	}
+	n := float64(len(r.categories))
+	return map50 / n, mapAll / n
+}
+
+// Prints the mAP along with each category's AP to w.
+func (r *evaluationResult) Print(w io.Writer) {
+	fmt.Fprintf(w, "Evaluated %d images (%d failed)\n", r.imagesEvaluated,
+		r.imagesFailed)
+	map50, mapAll := r.meanAP()
+	fmt.Fprintf(w, "mAP@0.5: %.4f\n", map50)
+	fmt.Fprintf(w, "mAP@0.5:0.95: %.4f\n", mapAll)
+	fmt.Fprintf(w, "%-20s %8s %8s %12s\n", "Class", "Objects", "AP@0.5",
+		"AP@0.5:0.95")
+	for _, c := range r.categories {
+		fmt.Fprintf(w, "%-20s %8d %8.4f %12.4f\n", c.name, c.numGroundTruth,
+			c.ap[0], c.apAll())
+	}
+}
+
+// Writes each category's precision/recall curve at an IoU threshold of 0.5
+// to a CSV file with the columns class, recall and precision.
+func (r *evaluationResult) writePRCurves(path string) error {
+	f, e := os.Create(path)
+	if e != nil {
+		return fmt.Errorf("Error creating %s: %w", path, e)
+	}
+	defer f.Close()
+	_, e = fmt.Fprintf(f, "class,recall,precision\n")
+	if e != nil {
+		return fmt.Errorf("Error writing %s: %w", path, e)
+	}
+	for _, c := range r.categories {
+		for i, p := range c.precision50 {
+			recall := float64(i) / float64(evalRecallPoints-1)
+			_, e = fmt.Fprintf(f, "%q,%.2f,%.6f\n", c.name, recall, p)
+			if e != nil {
+				return fmt.Errorf("Error writing %s: %w", path, e)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the COCO category ID to use for boxes with the given class ID. If
+// the class's label matches the name of one of the dataset's categories, that
+// category is used. Otherwise, the category ID is chosen by cocoCategoryID, as
+// in the "coco" output format: COCO's category IDs if the labels are the 80
+// COCO classes, or else the class ID plus one.
+func (d *cocoDataset) categoryForClass(classID int) int {
+	label := classLabel(classID)
+	for _, c := range d.Categories {
+		if c.Name == label {
+			return c.ID
+		}
+	}
+	return cocoCategoryID(classID)
+}
+
+// Converts the boxes detected in one image to evalBoxes, keeping only the
+// evalMaxDetectionsPerImage most confident boxes in each category.
+func (d *cocoDataset) evalDetections(imageID int,
+	boxes []boundingBox) []evalBox {
+	sorted := make([]boundingBox, len(boxes))
+	copy(sorted, boxes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].confidence > sorted[j].confidence
+	})
+	perCategory := make(map[int]int)
+	toReturn := make([]evalBox, 0, len(sorted))
+	for _, b := range sorted {
+		categoryID := d.categoryForClass(b.classID)
+		if perCategory[categoryID] >= evalMaxDetectionsPerImage {
+			continue
+		}
+		perCategory[categoryID]++
+		toReturn = append(toReturn, evalBox{
+			imageID:    imageID,
+			categoryID: categoryID,
+			box:        b,
+		})
+	}
+	return toReturn
+}
+
+// Runs detection on each image in the dataset, loading the images relative
+// to imageDir, and computes the AP of each category. Images that fail to
+// load or process are reported (unless quiet is set) and counted, and any
+// ground truth boxes in them are ignored.
+func evaluateDataset(d *detector, dataset *cocoDataset, imageDir string,
+	quiet bool) *evaluationResult {
+	toReturn := &evaluationResult{}
+	var groundTruth, detections []evalBox
+	evaluated := make(map[int]bool)
+	for _, img := range dataset.Images {
+		path := filepath.Join(imageDir, img.FileName)
+		pic, e := loadImageFile(path)
+		if e == nil {
+			var boxes []boundingBox
+			boxes, _, e = d.detect(pic)
+			detections = append(detections,
+				dataset.evalDetections(img.ID, boxes)...)
+		}
+		if e != nil {
+			toReturn.imagesFailed++
+			if !quiet {
+				fmt.Printf("Error processing %s: %s\n", path, e)
+			}
+			continue
+		}
+		toReturn.imagesEvaluated++
+		evaluated[img.ID] = true
+	}
+	for _, a := range dataset.Annotations {
+		if !evaluated[a.ImageID] {
+			continue
+		}
+		groundTruth = append(groundTruth, evalBox{
+			imageID:    a.ImageID,
+			categoryID: a.CategoryID,
+			box: boundingBox{
+				x1: a.BBox[0],
+				y1: a.BBox[1],
+				x2: a.BBox[0] + a.BBox[2],
+				y2: a.BBox[1] + a.BBox[3],
+			},
+			isCrowd: a.IsCrowd != 0,
+		})
+	}
+
+	for _, c := range dataset.Categories {
+		result := evaluateCategory(c.ID, groundTruth, detections)
+		if result == nil {
+			continue
+		}
+		result.name = c.Name
+		toReturn.categories = append(toReturn.categories, result)
+	}
+	return toReturn
+}
+
+// Computes the AP of a single category at each IoU threshold. Returns nil if
+// the category has no (non-crowd) ground truth boxes, in which case its AP
+// is undefined.
+func evaluateCategory(categoryID int, allGroundTruth,
+	allDetections []evalBox) *categoryResult {
+	groundTruth := make(map[int][]evalBox)
+	numGroundTruth := 0
+	for _, g := range allGroundTruth {
+		if g.categoryID != categoryID {
+			continue
+		}
+		groundTruth[g.imageID] = append(groundTruth[g.imageID], g)
+		if !g.isCrowd {
+			numGroundTruth++
+		}
+	}
+	if numGroundTruth == 0 {
+		return nil
+	}
+	var detections []evalBox
+	for _, d := range allDetections {
+		if d.categoryID == categoryID {
+			detections = append(detections, d)
+		}
+	}
+	sort.SliceStable(detections, func(i, j int) bool {
+		return detections[i].box.confidence > detections[j].box.confidence
+	})
+
+	toReturn := &categoryResult{
+		categoryID:     categoryID,
+		numGroundTruth: numGroundTruth,
+		ap:             make([]float64, len(evalIoUThresholds)),
+	}
+	for t, threshold := range evalIoUThresholds {
+		precision := matchDetections(detections, groundTruth, numGroundTruth,
+			threshold)
+		sum := 0.0
+		for _, p := range precision {
+			sum += p
+		}
+		toReturn.ap[t] = sum / float64(len(precision))
+		if t == 0 {
+			toReturn.precision50 = precision
+		}
+	}
+	return toReturn
+}
+
+// Greedily matches the detections, which must be sorted by decreasing
+// confidence, to the ground truth boxes in the same image, and returns the
+// interpolated precision at each of evalRecallPoints evenly spaced recall
+// values. Each detection is matched with the unmatched ground truth box with
+// which it has the highest IoU, if the IoU is at least threshold. Detections
+// matching only crowd regions are ignored.
+func matchDetections(detections []evalBox, groundTruth map[int][]evalBox,
+	numGroundTruth int, threshold float32) []float64 {
+	matched := make(map[int][]bool)
+	for imageID, boxes := range groundTruth {
+		matched[imageID] = make([]bool, len(boxes))
+	}
+	var recalls, precisions []float64
+	truePositives, falsePositives := 0, 0
+	for i := range detections {
+		d := &(detections[i])
+		boxes := groundTruth[d.imageID]
+		best := -1
+		bestIoU := threshold
+		crowdMatch := false
+		for j := range boxes {
+			g := &(boxes[j])
+			if g.isCrowd {
+				// COCO matches crowd regions using the fraction of the
+				// detection covered by the region, rather than the IoU.
+				area := d.box.area()
+				if (area > 0) && (d.box.intersection(&g.box)/area >= threshold) {
+					crowdMatch = true
+				}
+				continue
+			}
+			if matched[d.imageID][j] {
+				continue
+			}
+			iou := d.box.iou(&g.box)
+			if iou >= bestIoU {
+				best = j
+				bestIoU = iou
+			}
+		}
+		if best >= 0 {
+			matched[d.imageID][best] = true
+			truePositives++
+		} else if crowdMatch {
+			continue
+		} else {
+			falsePositives++
+		}
+		recalls = append(recalls,
+			float64(truePositives)/float64(numGroundTruth))
+		precisions = append(precisions, float64(truePositives)/
+			float64(truePositives+falsePositives))
+	}
+
+	// Make the precision monotonically decreasing, so that the precision at
+	// each recall is the best precision achievable at that recall or higher.
+	for i := len(precisions) - 2; i >= 0; i-- {
+		precisions[i] = max(precisions[i], precisions[i+1])
+	}
+	toReturn := make([]float64, evalRecallPoints)
+	j := 0
+	for i := range toReturn {
+		recall := float64(i) / float64(evalRecallPoints-1)
+		for (j < len(recalls)) && (recalls[j] < recall) {
+			j++
+		}
+		if j >= len(recalls) {
+			// Recalls this high are never reached, so the precision is 0.
+			break
+		}
+		toReturn[i] = precisions[j]
+	}
+	return toReturn
+}
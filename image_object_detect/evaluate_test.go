@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"testing"
+
+	ort "github.com/yalue/onnxruntime_go"
+	"github.com/yalue/onnxruntime_go_examples/common/benchmark"
+	"github.com/yalue/onnxruntime_go_examples/common/ortlib"
+	"github.com/yalue/onnxruntime_go_examples/common/provider"
+	"github.com/yalue/onnxruntime_go_examples/common/sessionopts"
+)
+
+func newEvalBox(imageID, categoryID int, confidence, x1, y1, x2,
+	y2 float32) evalBox {
+	return evalBox{
+		imageID:    imageID,
+		categoryID: categoryID,
+		box: boundingBox{
+			confidence: confidence,
+			x1:         x1,
+			y1:         y1,
+			x2:         x2,
+			y2:         y2,
+		},
+	}
+}
+
+// Fails the test if any of the AP values in r differ from expected.
+func checkAP(t *testing.T, r *categoryResult, expected float64) {
+	if r == nil {
+		t.Fatalf("Didn't get a result for the category")
+	}
+	for i, ap := range r.ap {
+		if math.Abs(ap-expected) > 1e-9 {
+			t.Fatalf("Expected an AP of %f at IoU %f, got %f", expected,
+				evalIoUThresholds[i], ap)
+		}
+	}
+}
+
+func TestEvaluateCategoryPerfectMatch(t *testing.T) {
+	groundTruth := []evalBox{
+		newEvalBox(1, 3, 0, 10, 10, 50, 50),
+		newEvalBox(1, 3, 0, 100, 100, 140, 180),
+		newEvalBox(2, 3, 0, 0, 0, 20, 30),
+		// A different category, which shouldn't affect the result.
+		newEvalBox(2, 1, 0, 200, 200, 220, 220),
+	}
+	detections := []evalBox{
+		newEvalBox(2, 3, 0.7, 0, 0, 20, 30),
+		newEvalBox(1, 3, 0.9, 10, 10, 50, 50),
+		newEvalBox(1, 3, 0.8, 100, 100, 140, 180),
+	}
+	r := evaluateCategory(3, groundTruth, detections)
+	if r.numGroundTruth != 3 {
+		t.Fatalf("Expected 3 ground truth boxes, got %d", r.numGroundTruth)
+	}
+	checkAP(t, r, 1)
+	for i, p := range r.precision50 {
+		if p != 1 {
+			t.Fatalf("Expected a precision of 1 at recall point %d, got %f",
+				i, p)
+		}
+	}
+}
+
+func TestMatchDetectionsOrdering(t *testing.T) {
+	groundTruth := []evalBox{newEvalBox(1, 3, 0, 10, 10, 50, 50)}
+	truePositive := newEvalBox(1, 3, 0.8, 10, 10, 50, 50)
+	falsePositive := newEvalBox(1, 3, 0.9, 300, 300, 340, 340)
+
+	// The false positive is more confident, so the only point on the curve
+	// reaching full recall has a precision of 0.5.
+	r := evaluateCategory(3, groundTruth,
+		[]evalBox{truePositive, falsePositive})
+	checkAP(t, r, 0.5)
+
+	// If the true positive is more confident, the false positive comes
+	// after all of the ground truth has been found, so it doesn't matter.
+	falsePositive.box.confidence = 0.7
+	r = evaluateCategory(3, groundTruth,
+		[]evalBox{truePositive, falsePositive})
+	checkAP(t, r, 1)
+
+	// A second detection of an already-matched object is a false positive.
+	groundTruth = append(groundTruth,
+		newEvalBox(1, 3, 0, 300, 300, 340, 340))
+	duplicate := truePositive
+	duplicate.box.confidence = 0.5
+	secondObject := newEvalBox(1, 3, 0.4, 300, 300, 340, 340)
+	r = evaluateCategory(3, groundTruth,
+		[]evalBox{truePositive, duplicate, secondObject})
+	// Recall 0.5 is reached with a precision of 1, and recall 1 with a
+	// precision of 2/3. Precision is sampled at 101 recall values, 51 of
+	// which are at most 0.5.
+	expected := (51*1.0 + 50*(2.0/3.0)) / 101
+	checkAP(t, r, expected)
+}
+
+func TestMatchDetectionsCrowd(t *testing.T) {
+	crowd := newEvalBox(1, 1, 0, 0, 0, 200, 200)
+	crowd.isCrowd = true
+	groundTruth := []evalBox{
+		crowd,
+		newEvalBox(1, 1, 0, 300, 300, 340, 380),
+	}
+	// A confident detection of part of the crowd region is ignored rather
+	// than counted as a false positive, even though its IoU with the region
+	// is low.
+	detections := []evalBox{
+		newEvalBox(1, 1, 0.9, 10, 10, 40, 40),
+		newEvalBox(1, 1, 0.8, 300, 300, 340, 380),
+	}
+	r := evaluateCategory(1, groundTruth, detections)
+	if r.numGroundTruth != 1 {
+		t.Fatalf("Crowd regions shouldn't be counted as ground truth, got "+
+			"%d ground truth boxes", r.numGroundTruth)
+	}
+	checkAP(t, r, 1)
+
+	// A detection outside of the crowd region is still a false positive.
+	detections[0] = newEvalBox(1, 1, 0.9, 250, 10, 290, 40)
+	r = evaluateCategory(1, groundTruth, detections)
+	checkAP(t, r, 0.5)
+
+	// A category with only crowd regions has no AP.
+	r = evaluateCategory(1, []evalBox{crowd}, detections)
+	if r != nil {
+		t.Fatalf("Expected no result for a category containing only crowd "+
+			"regions, got AP %v", r.ap)
+	}
+}
+
+func TestEvaluateCategoryEmptyGroundTruth(t *testing.T) {
+	detections := []evalBox{newEvalBox(1, 3, 0.9, 10, 10, 50, 50)}
+	r := evaluateCategory(3, nil, detections)
+	if r != nil {
+		t.Fatalf("Expected no result without ground truth, got AP %v", r.ap)
+	}
+	r = evaluateCategory(3, []evalBox{newEvalBox(1, 1, 0, 10, 10, 50, 50)},
+		detections)
+	if r != nil {
+		t.Fatalf("Expected no result without ground truth in the category, "+
+			"got AP %v", r.ap)
+	}
+
+	// Detections in images without any ground truth boxes are false
+	// positives.
+	groundTruth := map[int][]evalBox{
+		1: {newEvalBox(1, 3, 0, 10, 10, 50, 50)},
+	}
+	detections = []evalBox{
+		newEvalBox(2, 3, 0.9, 10, 10, 50, 50),
+		newEvalBox(1, 3, 0.8, 10, 10, 50, 50),
+	}
+	precision := matchDetections(detections, groundTruth, 1, 0.5)
+	if precision[evalRecallPoints-1] != 0.5 {
+		t.Fatalf("Expected a precision of 0.5 at full recall, got %f",
+			precision[evalRecallPoints-1])
+	}
+
+	// No detections at all means a precision of 0 everywhere.
+	precision = matchDetections(nil, groundTruth, 1, 0.5)
+	for i, p := range precision {
+		if p != 0 {
+			t.Fatalf("Expected a precision of 0 without detections, got %f "+
+				"at recall point %d", p, i)
+		}
+	}
+}
+
+func TestEvalDetectionsLimitPerCategory(t *testing.T) {
+	var dataset cocoDataset
+	e := json.Unmarshal([]byte(`{"categories": [
+		{"id": 3, "name": "car"},
+		{"id": 1, "name": "person"}
+	]}`), &dataset)
+	if e != nil {
+		t.Fatalf("Error parsing the categories: %s", e)
+	}
+	carClass, personClass := -1, -1
+	for i, label := range yoloClasses {
+		switch label {
+		case "car":
+			carClass = i
+		case "person":
+			personClass = i
+		}
+	}
+	var boxes []boundingBox
+	for i := 0; i < evalMaxDetectionsPerImage+10; i++ {
+		confidence := float32(i+1) / 1000
+		boxes = append(boxes, boundingBox{
+			label:      "car",
+			classID:    carClass,
+			confidence: confidence,
+		}, boundingBox{
+			label:      "person",
+			classID:    personClass,
+			confidence: confidence,
+		})
+	}
+	detections := dataset.evalDetections(7, boxes)
+	counts := make(map[int]int)
+	for _, d := range detections {
+		if d.imageID != 7 {
+			t.Fatalf("Got a detection for image %d, expected 7", d.imageID)
+		}
+		counts[d.categoryID]++
+		// The 10 least confident boxes of each category should be dropped.
+		if d.box.confidence <= 0.01 {
+			t.Fatalf("Got a box with confidence %f, which should have been "+
+				"dropped", d.box.confidence)
+		}
+	}
+	if (counts[3] != evalMaxDetectionsPerImage) ||
+		(counts[1] != evalMaxDetectionsPerImage) {
+		t.Fatalf("Expected %d detections of each category, got %v",
+			evalMaxDetectionsPerImage, counts)
+	}
+}
+
+// The minimum mAP@0.5 and mAP@0.5:0.95 that yolov8n.onnx must reach on
+// car_coco_annotations.json. Keep these in sync with the README.
+const (
+	carFixtureMinMAP50 = 0.4
+	carFixtureMinMAP   = 0.25
+)
+
+// Runs the bundled network on the bundled fixture, using the same settings
+// as -evaluate, to catch changes that hurt accuracy. Skipped if the network
+// or the onnxruntime library isn't available.
+func TestEvaluateCarFixture(t *testing.T) {
+	if _, e := os.Stat(modelPath); e != nil {
+		t.Skipf("%s isn't available: %s", modelPath, e)
+	}
+	sessionConfig := &sessionopts.Config{
+		Provider:          &provider.Config{Name: "cpu"},
+		OptimizationLevel: "all",
+		ExecutionMode:     "sequential",
+		MemPattern:        true,
+		CPUMemArena:       true,
+	}
+	session, e := initSession("", 1, taskDetect, "auto", sessionConfig)
+	var notFound *ortlib.NotFoundError
+	if errors.As(e, &notFound) {
+		t.Skipf("The onnxruntime library isn't available: %s", e)
+	}
+	if e != nil {
+		t.Fatalf("Error creating the session: %s", e)
+	}
+	defer ort.DestroyEnvironment()
+	defer session.Destroy()
+	e = setupClassLabels(session, false, true)
+	if e != nil {
+		t.Fatalf("Error setting up class labels: %s", e)
+	}
+	d := &detector{
+		session: session,
+		options: &DetectionOptions{
+			ConfidenceThreshold: 0.001,
+			IoUThreshold:        0.7,
+			NMSMethod:           NMSClassAware,
+		},
+		letterbox: true,
+		timing:    benchmark.NewTimer(),
+	}
+	dataset, e := loadCOCODataset("car_coco_annotations.json")
+	if e != nil {
+		t.Fatalf("Error loading the fixture: %s", e)
+	}
+	result := evaluateDataset(d, dataset, ".", true)
+	if result.imagesFailed != 0 {
+		t.Fatalf("Failed to process %d images", result.imagesFailed)
+	}
+	map50, mapAll := result.meanAP()
+	t.Logf("mAP@0.5: %.4f, mAP@0.5:0.95: %.4f", map50, mapAll)
+	if map50 < carFixtureMinMAP50 {
+		t.Errorf("mAP@0.5 of %.4f is below %.4f", map50, carFixtureMinMAP50)
+	}
+	if mapAll < carFixtureMinMAP {
+		t.Errorf("mAP@0.5:0.95 of %.4f is below %.4f", mapAll,
+			carFixtureMinMAP)
+	}
+}
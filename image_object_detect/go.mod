@@ -3,7 +3,11 @@ module github.com/yalue/onnxruntime_go_examples/image_object_detect
 go 1.21.0
 
 require (
-	github.com/8ff/prettyTimer v0.0.0-20230830184900-c96793faf613
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
 	github.com/yalue/onnxruntime_go v1.25.0
+	github.com/yalue/onnxruntime_go_examples/common v0.0.0
+	golang.org/x/image v0.18.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+replace github.com/yalue/onnxruntime_go_examples/common => ../common
@@ -1,28 +1,87 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"image"
+	"image/color"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
 	"os"
-	"runtime"
-	"sort"
+	"path/filepath"
+	"strconv"
+	"strings"
 
-	"github.com/8ff/prettyTimer"
-	"github.com/nfnt/resize"
 	ort "github.com/yalue/onnxruntime_go"
+	"github.com/yalue/onnxruntime_go_examples/common/benchmark"
+	"github.com/yalue/onnxruntime_go_examples/common/imageutil"
+	"github.com/yalue/onnxruntime_go_examples/common/ortlib"
+	"github.com/yalue/onnxruntime_go_examples/common/sessionopts"
 )
 
 var modelPath = "./yolov8n.onnx"
 var imagePath = "./car.png"
-var useCoreML = false
+
+// Transparent pixels in input images are composited onto this color.
+var imageBackground color.Color = imageutil.DefaultBackground
 
 type ModelSession struct {
 	Session *ort.AdvancedSession
 	Input   *ort.Tensor[float32]
 	Output  *ort.Tensor[float32]
+	// The prototype masks output by segmentation networks. Nil for other
+	// tasks.
+	MaskProtos *ort.Tensor[float32]
+	Task       modelTask
+	// Converts the output of detection networks into boxes. Other tasks
+	// always use the YOLOv8 layout.
+	Decoder outputDecoder
+}
+
+// Identifies the kind of YOLOv8 network being run, which determines the
+// network's outputs and how they're decoded.
+type modelTask int
+
+const (
+	// Networks such as yolov8n.onnx, with a single "output0" output.
+	taskDetect modelTask = iota
+	// Networks such as yolov8n-seg.onnx, which additionally output mask
+	// coefficients for each box, and a set of prototype masks in "output1".
+	taskSegment
+	// Networks such as yolov8n-pose.onnx, which additionally output 17
+	// keypoints for each box.
+	taskPose
+	// Networks such as yolov8n-obb.onnx, which additionally output a
+	// rotation angle for each box.
+	taskOBB
+)
+
+func (t modelTask) String() string {
+	switch t {
+	case taskDetect:
+		return "detect"
+	case taskSegment:
+		return "segment"
+	case taskPose:
+		return "pose"
+	case taskOBB:
+		return "obb"
+	}
+	return fmt.Sprintf("unknown task %d", int(t))
+}
+
+// Converts the name of a task, as returned by modelTask.String(), to the
+// modelTask.
+func parseModelTask(name string) (modelTask, error) {
+	for _, t := range []modelTask{taskDetect, taskSegment, taskPose,
+		taskOBB} {
+		if name == t.String() {
+			return t, nil
+		}
+	}
+	return taskDetect, fmt.Errorf("Unknown task %q", name)
 }
 
 func main() {
@@ -30,184 +89,1059 @@ func main() {
 }
 
 func run() int {
-	timingStats := prettyTimer.NewTimingStats()
-
-	if os.Getenv("USE_COREML") == "true" {
-		useCoreML = true
+	var inputImagePath, inputDir, inputGlob string
+	var confidenceThreshold, iouThreshold float64
+	var maxDetections int
+	var classList string
+	var outputImagePath, outputImageDir string
+	var stretchInput bool
+	var nmsMethodName string
+	var softNMSSigma float64
+	var outputFormat, outputPath string
+	var batchSize int
+	var benchmarkIterations int
+	var taskName, maskOverlayPath string
+	var decoderName string
+	var labelsPath string
+	var tileSize int
+	var tileOverlap, tileMergeThreshold float64
+	var trackObjects bool
+	var trackLowConfidence, trackIoU float64
+	var trackMaxAge, trackMinHits int
+	var evalAnnotations, evalImageDir, evalPRCurvesPath string
+	var evalMinMAP50, evalMinMAP float64
+	var analyticsConfigPath, analyticsOutputPath string
+	var redactClassList, redactMethodName string
+	var redactedImagePath, redactedImageDir string
+	var redactStrength int
+	var cropDir string
+	var cropPadding float64
+	var cropMinSize int
+	var backgroundName string
+	var inputGIF, inputMJPEG, outputGIFPath string
+	var maxFrames, outputGIFFPS int
+	flag.StringVar(&modelPath, "model", modelPath,
+		"The path to the .onnx network to run.")
+	onnxruntimeLibPath := ortlib.AddFlag()
+	sessionConfig := sessionopts.AddFlags()
+	benchmarkConfig := benchmark.AddFlags()
+	flag.StringVar(&taskName, "task", "detect",
+		"The kind of network given by -model. Must be \"detect\" for "+
+			"detection networks such as yolov8n.onnx, \"segment\" for "+
+			"instance segmentation networks such as yolov8n-seg.onnx, "+
+			"\"pose\" for pose networks such as yolov8n-pose.onnx, or "+
+			"\"obb\" for rotated box networks such as yolov8n-obb.onnx.")
+	flag.StringVar(&decoderName, "decoder", "auto",
+		"The layout of the detection network's output. Must be \"v5\", "+
+			"\"v8\", \"v10\", \"v11\" (the same as v8), or \"auto\" to "+
+			"choose based on the shape of the network's output.")
+	flag.StringVar(&labelsPath, "labels", "",
+		"A file containing the name of each class output by the network. "+
+			"Either a text file with one name per line, or an Ultralytics "+
+			"dataset .yaml file. If unset, the names are read from the "+
+			"network's metadata if possible, or else the COCO class names "+
+			"are used.")
+	flag.StringVar(&maskOverlayPath, "mask_overlay", "",
+		"With -task segment, saves a copy of the input image with each "+
+			"instance's mask overlaid in its class's color to this path.")
+	flag.StringVar(&inputImagePath, "image", imagePath,
+		"The image to process, if none of -input_dir, -input_glob, "+
+			"-input_gif or -input_mjpeg are set. Use -benchmark to process "+
+			"it repeatedly and collect timing statistics.")
+	flag.StringVar(&backgroundName, "background", "white",
+		"The color onto which transparent pixels in input images are "+
+			"composited, as \"#rrggbb\" or one of \"white\", \"black\" or "+
+			"\"gray\".")
+	flag.StringVar(&inputDir, "input_dir", "",
+		"If set, every .png, .jpg, .jpeg or .gif image in this directory "+
+			"(including subdirectories) is processed once.")
+	flag.StringVar(&inputGlob, "input_glob", "",
+		"If set, every image matching this glob pattern (e.g. "+
+			"\"frames/*.jpg\") is processed once.")
+	flag.StringVar(&inputGIF, "input_gif", "",
+		"If set, every frame of this animated GIF is processed once.")
+	flag.StringVar(&inputMJPEG, "input_mjpeg", "",
+		"If set, every frame of this MJPEG stream is processed once. May be "+
+			"a file path, a \"tcp://host:port\" address, or an HTTP URL "+
+			"such as an IP camera's MJPEG stream.")
+	flag.IntVar(&maxFrames, "max_frames", 0,
+		"If positive, stop after processing this many images or frames. "+
+			"Useful with endless MJPEG streams.")
+	flag.StringVar(&outputGIFPath, "output_gif", "",
+		"When processing multiple images or frames, an animated GIF with "+
+			"the boxes drawn on each frame will be saved to this path, if "+
+			"set. Frames are scaled to fit the first frame's size. Requires "+
+			"-max_frames with -input_mjpeg.")
+	flag.IntVar(&outputGIFFPS, "output_gif_fps", 10,
+		"The frame rate of the -output_gif animation. Ignored when using "+
+			"-input_gif, in which case the input's frame delays are kept.")
+	flag.IntVar(&batchSize, "batch_size", 1,
+		"The number of images to pack into each run of the network when "+
+			"processing multiple images or frames. Values above 1 require "+
+			"a network exported with a dynamic batch dimension.")
+	flag.IntVar(&tileSize, "tile_size", 0,
+		"If positive, each image is split into overlapping square tiles "+
+			"of this many pixels, detection is run on each tile, and the "+
+			"results are merged. Helps to detect small objects in large "+
+			"images. Up to -batch_size tiles are processed at once.")
+	flag.Float64Var(&tileOverlap, "tile_overlap", 0.2,
+		"The fraction of each tile's size by which adjacent tiles overlap "+
+			"when using -tile_size.")
+	flag.Float64Var(&tileMergeThreshold, "tile_merge_threshold", 0.5,
+		"When using -tile_size, boxes of the same class from different "+
+			"tiles are merged into one if the area of their intersection, "+
+			"divided by the area of the smaller box, exceeds this. An object "+
+			"cut by a tile's edge produces a partial box whose IoU with the "+
+			"full box is low, so -iou_threshold alone doesn't merge them. "+
+			"Set to 1 to only use -iou_threshold.")
+	flag.BoolVar(&trackObjects, "track", false,
+		"If set, the images given by -input_dir or -input_glob are treated "+
+			"as consecutive video frames, sorted by the numbers in their "+
+			"names, and objects are tracked across frames. Use with "+
+			"-output_format tracks or mot.")
+	flag.Float64Var(&trackLowConfidence, "track_low_confidence", 0.1,
+		"With -track, boxes with a confidence between this and -confidence "+
+			"are only used to continue existing tracks.")
+	flag.Float64Var(&trackIoU, "track_iou", 0.3,
+		"With -track, the minimum IoU between a box and a track's predicted "+
+			"position for the box to be associated with the track.")
+	flag.IntVar(&trackMaxAge, "track_max_age", 30,
+		"With -track, the number of frames a track is kept without being "+
+			"associated with any box.")
+	flag.IntVar(&trackMinHits, "track_min_hits", 3,
+		"With -track, the number of frames in which an object must be "+
+			"detected before its track is reported.")
+	flag.StringVar(&evalAnnotations, "evaluate", "",
+		"If set to a COCO-format annotation JSON file, runs detection on "+
+			"each image it lists and reports the mAP and each class's AP, "+
+			"rather than reporting detections. Unless -confidence is set, "+
+			"a confidence threshold of 0.001 is used, as is usual for mAP.")
+	flag.StringVar(&evalImageDir, "eval_image_dir", "",
+		"The directory containing the images listed in the -evaluate "+
+			"annotations. Defaults to the annotation file's directory.")
+	flag.StringVar(&evalPRCurvesPath, "eval_pr_curves", "",
+		"With -evaluate, writes each class's precision/recall curve at an "+
+			"IoU of 0.5 to this CSV file, if set.")
+	flag.Float64Var(&evalMinMAP50, "eval_min_map50", 0,
+		"With -evaluate, exit with an error if the mAP@0.5 is below this.")
+	flag.Float64Var(&evalMinMAP, "eval_min_map", 0,
+		"With -evaluate, exit with an error if the mAP@0.5:0.95 is below "+
+			"this.")
+	flag.StringVar(&analyticsConfigPath, "analytics_config", "",
+		"A JSON file defining polygonal zones in which to count boxes, and "+
+			"lines across which to count tracked objects. Configs with lines "+
+			"require -track. If set, the counts for each image are written "+
+			"to -analytics_output.")
+	flag.StringVar(&analyticsOutputPath, "analytics_output",
+		"analytics.jsonl",
+		"Where to write the per-image counts when using -analytics_config, "+
+			"as one JSON object per line, or \"-\" for stdout.")
+	flag.Float64Var(&confidenceThreshold, "confidence", 0.5,
+		"The minimum class probability for a box to be reported.")
+	flag.Float64Var(&iouThreshold, "iou", 0.7,
+		"Boxes overlapping a higher-confidence box by more than this IoU "+
+			"are suppressed.")
+	flag.IntVar(&maxDetections, "max_detections", 0,
+		"The maximum number of boxes to report per image. 0 means no limit.")
+	flag.StringVar(&classList, "classes", "",
+		"An optional comma-separated list of class names or IDs to report. "+
+			"If empty, all classes are reported.")
+	flag.StringVar(&nmsMethodName, "nms", "class",
+		"How overlapping boxes are suppressed. Must be one of \"class\" "+
+			"(only boxes with the same class suppress each other), "+
+			"\"agnostic\" (any overlapping boxes suppress each other), or "+
+			"\"soft\" (per-class Gaussian soft-NMS).")
+	flag.Float64Var(&softNMSSigma, "soft_nms_sigma", 0.5,
+		"The Gaussian sigma used to decay overlapping scores with -nms soft.")
+	flag.StringVar(&outputImagePath, "output_image", "",
+		"If set, a copy of the input image with the detected boxes drawn on "+
+			"it will be saved to this path. Must end in .png, .jpg or .jpeg.")
+	flag.StringVar(&outputImageDir, "output_image_dir", "",
+		"When processing multiple images, annotated copies of each image "+
+			"will be saved in this directory, if set.")
+	flag.StringVar(&outputFormat, "output_format", "text",
+		"The format in which detections are reported. Must be one of "+
+			"\"text\", \"jsonl\" (one JSON object per box), \"coco\" (a "+
+			"COCO results JSON array), \"yolo\" (one YOLO-format .txt "+
+			"label file per image), or, with -track, \"tracks\" (one JSON "+
+			"object per frame) or \"mot\" (MOTChallenge text).")
+	flag.StringVar(&outputPath, "output_path", "-",
+		"Where to write detections for the jsonl, coco, tracks and mot "+
+			"formats, or \"-\" for stdout. For the yolo format, this is the "+
+			"directory in which label files are created.")
+	flag.StringVar(&redactedImagePath, "redacted_image", "",
+		"If set, a copy of the input image in which the boxes of the "+
+			"-redact_classes are blurred or pixelated will be saved to this "+
+			"path. Must end in .png, .jpg or .jpeg.")
+	flag.StringVar(&redactedImageDir, "redacted_image_dir", "",
+		"When processing multiple images, redacted copies of each image "+
+			"will be saved in this directory, if set. With -track, every box "+
+			"detected in each frame is redacted, not just tracked objects.")
+	flag.StringVar(&redactClassList, "redact_classes", "person",
+		"A comma-separated list of class names or IDs to redact in the "+
+			"images saved by -redacted_image or -redacted_image_dir. If "+
+			"empty, every detected box is redacted.")
+	flag.StringVar(&redactMethodName, "redact_method", "blur",
+		"How redacted boxes are obscured. Must be \"blur\" (Gaussian "+
+			"blur) or \"pixelate\".")
+	flag.IntVar(&redactStrength, "redact_strength", 0,
+		"The standard deviation of the blur, or the size of each pixelated "+
+			"block, in pixels. If 0, this is chosen based on each box's "+
+			"size.")
+	flag.StringVar(&cropDir, "crop_dir", "",
+		"If set, each detected box is saved as its own cropped PNG image "+
+			"in this directory, named by its class and confidence, along "+
+			"with an index.csv file listing every crop.")
+	flag.Float64Var(&cropPadding, "crop_padding", 0.1,
+		"The fraction of each box's width and height added to each side "+
+			"of the box when saving crops to -crop_dir.")
+	flag.IntVar(&cropMinSize, "crop_min_size", 16,
+		"Boxes narrower or shorter than this many pixels aren't saved to "+
+			"-crop_dir.")
+	flag.BoolVar(&stretchInput, "stretch", false,
+		"If set, input images are stretched to the network's input size "+
+			"rather than letterboxed, which distorts their aspect ratio.")
+	flag.IntVar(&benchmarkIterations, "benchmark_preprocess", 0,
+		"If set to a positive number, compare the speed of the fast image "+
+			"preprocessing path against the original per-pixel "+
+			"implementation using this many iterations on the -image, then "+
+			"exit. Doesn't require onnxruntime.")
+	flag.Parse()
+	e := sessionConfig.Validate()
+	if e != nil {
+		fmt.Printf("Invalid session settings: %s\n", e)
+		return 1
+	}
+	e = benchmarkConfig.Validate()
+	if e != nil {
+		fmt.Printf("Invalid benchmark settings: %s\n", e)
+		return 1
+	}
+	background, e := imageutil.ParseColor(backgroundName)
+	if e != nil {
+		fmt.Printf("Invalid -background setting: %s\n", e)
+		return 1
+	}
+	imageBackground = background
+	if evalAnnotations != "" {
+		confidenceSet := false
+		flag.Visit(func(f *flag.Flag) {
+			confidenceSet = confidenceSet || (f.Name == "confidence")
+		})
+		if !confidenceSet {
+			confidenceThreshold = 0.001
+		}
+	}
+	if benchmarkIterations > 0 {
+		pic, e := loadImageFile(inputImagePath)
+		if e != nil {
+			fmt.Printf("Error loading input image: %s\n", e)
+			return 1
+		}
+		benchmarkPreprocessing(pic, benchmarkIterations)
+		return 0
+	}
+	task, e := parseModelTask(taskName)
+	if e != nil {
+		fmt.Printf("Invalid -task setting: %s\n", e)
+		return 1
+	}
+	nmsMethod, e := parseNMSMethod(nmsMethodName)
+	if e != nil {
+		fmt.Printf("Invalid -nms setting: %s\n", e)
+		return 1
+	}
+	redactMethod, e := parseRedactionMethod(redactMethodName)
+	if e != nil {
+		fmt.Printf("Invalid -redact_method setting: %s\n", e)
+		return 1
+	}
+	if (tileOverlap < 0) || (tileOverlap >= 1) {
+		fmt.Printf("Invalid -tile_overlap: %f. Must be at least 0 and "+
+			"less than 1.\n", tileOverlap)
+		return 1
+	}
+	if (tileMergeThreshold < 0) || (tileMergeThreshold > 1) {
+		fmt.Printf("Invalid -tile_merge_threshold: %f. Must be between 0 "+
+			"and 1.\n", tileMergeThreshold)
+		return 1
+	}
+	if labelsPath != "" {
+		classLabels, e = loadClassLabels(labelsPath)
+		if e != nil {
+			fmt.Printf("Error loading class labels: %s\n", e)
+			return 1
+		}
+	}
+	inputSources := 0
+	for _, source := range []string{inputDir + inputGlob, inputGIF,
+		inputMJPEG} {
+		if source != "" {
+			inputSources++
+		}
+	}
+	if inputSources > 1 {
+		fmt.Printf("Only one of -input_dir or -input_glob, -input_gif and " +
+			"-input_mjpeg may be set\n")
+		return 1
+	}
+	batchMode := inputSources != 0
+	if trackObjects && !batchMode {
+		fmt.Printf("-track requires -input_dir, -input_glob, -input_gif " +
+			"or -input_mjpeg\n")
+		return 1
+	}
+	if benchmarkConfig.Enabled() && (batchMode || (evalAnnotations != "")) {
+		fmt.Printf("-benchmark only applies to a single -image. Timing " +
+			"statistics are always collected in batch mode\n")
+		return 1
+	}
+	if (outputGIFPath != "") && !batchMode {
+		fmt.Printf("-output_gif requires -input_dir, -input_glob, " +
+			"-input_gif or -input_mjpeg\n")
+		return 1
+	}
+	if (outputGIFPath != "") && (inputMJPEG != "") && (maxFrames <= 0) {
+		fmt.Printf("-output_gif requires -max_frames when using " +
+			"-input_mjpeg, since every frame is held in memory until the " +
+			"stream ends\n")
+		return 1
+	}
+	if outputGIFFPS <= 0 {
+		fmt.Printf("Invalid -output_gif_fps: %d\n", outputGIFFPS)
+		return 1
+	}
+	if !trackObjects && ((outputFormat == "tracks") ||
+		(outputFormat == "mot")) {
+		fmt.Printf("The %s output format requires -track\n", outputFormat)
+		return 1
+	}
+	var analytics *analyticsConfig
+	if analyticsConfigPath != "" {
+		analytics, e = loadAnalyticsConfig(analyticsConfigPath)
+		if e != nil {
+			fmt.Printf("Error loading analytics config: %s\n", e)
+			return 1
+		}
+		if (len(analytics.Lines) != 0) && !trackObjects {
+			fmt.Printf("The analytics config defines lines, but line "+
+				"crossings can only be counted for tracked objects. Set "+
+				"-track, or remove the lines from %s.\n", analyticsConfigPath)
+			return 1
+		}
+	}
+	var frames frameSource
+	var gifDelays []int
+	switch {
+	case inputGIF != "":
+		gifFrames, e := newGIFFrameSource(inputGIF)
+		if e != nil {
+			fmt.Printf("Error loading input GIF: %s\n", e)
+			return 1
+		}
+		gifDelays = gifFrames.delays()
+		frames = gifFrames
+	case inputMJPEG != "":
+		mjpegFrames, e := newMJPEGFrameSource(inputMJPEG)
+		if e != nil {
+			fmt.Printf("Error opening input MJPEG stream: %s\n", e)
+			return 1
+		}
+		defer mjpegFrames.Close()
+		frames = mjpegFrames
+	case batchMode:
+		batchPaths, e := findInputImages(inputDir, inputGlob)
+		if e != nil {
+			fmt.Printf("Error finding input images: %s\n", e)
+			return 1
+		}
+		if len(batchPaths) == 0 {
+			fmt.Printf("No input images were found.\n")
+			return 1
+		}
+		if trackObjects {
+			sortFramePaths(batchPaths)
+		}
+		inputRootDir = commonParentDir(batchPaths)
+		frames = newFileFrameSource(batchPaths)
 	}
 
-	// Read the input image into a image.Image object
-	pic, e := loadImageFile(imagePath)
+	detections, e := newDetectionWriter(outputFormat, outputPath)
 	if e != nil {
-		fmt.Printf("Error loading input image: %s\n", e)
+		fmt.Printf("Error setting up detection output: %s\n", e)
 		return 1
 	}
-	originalWidth := pic.Bounds().Canon().Dx()
-	originalHeight := pic.Bounds().Canon().Dy()
+	// Don't mix our own status messages with machine-readable output.
+	quiet := (outputFormat != "text") && (outputPath == "-")
+	if analyticsConfigPath != "" {
+		if (analyticsOutputPath == "-") &&
+			((outputFormat == "text") || (outputPath == "-")) {
+			fmt.Printf("Analytics and detections can't both be written to " +
+				"stdout. Set -analytics_output or -output_path.\n")
+			return 1
+		}
+		analyticsOutput, e := newAnalyticsWriter(analytics,
+			analyticsOutputPath)
+		if e != nil {
+			fmt.Printf("Error setting up analytics output: %s\n", e)
+			return 1
+		}
+		detections = multiDetectionWriter{detections, analyticsOutput}
+		quiet = quiet || (analyticsOutputPath == "-")
+	}
 
-	modelSession, e := initSession()
+	if !batchMode && (tileSize <= 0) {
+		// There's no point in a larger batch if we only have one image.
+		batchSize = 1
+	}
+	modelSession, e := initSession(*onnxruntimeLibPath, batchSize, task,
+		decoderName, sessionConfig)
 	if e != nil {
 		fmt.Printf("Error creating session and tensors: %s\n", e)
 		return 1
 	}
 	defer modelSession.Destroy()
 
-	// Run the detection 5 times
-	for i := 0; i < 5; i++ {
-		e = prepareInput(pic, modelSession.Input)
+	// Class names given by -classes can't be resolved until we know the
+	// labels, which may come from the network's metadata.
+	e = setupClassLabels(modelSession, labelsPath != "", quiet)
+	if e != nil {
+		fmt.Printf("Error setting up class labels: %s\n", e)
+		return 1
+	}
+	allowedClasses, e := parseClassList(classList)
+	if e != nil {
+		fmt.Printf("Invalid -classes list: %s\n", e)
+		return 1
+	}
+	var redaction *redactor
+	if (redactedImagePath != "") || (redactedImageDir != "") {
+		redactClasses, e := parseClassList(redactClassList)
 		if e != nil {
-			fmt.Printf("Error converting image to network input: %s\n", e)
+			fmt.Printf("Invalid -redact_classes list: %s\n", e)
 			return 1
 		}
+		redaction = &redactor{
+			classes:       redactClasses,
+			method:        redactMethod,
+			strength:      redactStrength,
+			minConfidence: float32(confidenceThreshold),
+		}
+	}
+	detectionOptions := &DetectionOptions{
+		ConfidenceThreshold: float32(confidenceThreshold),
+		IoUThreshold:        float32(iouThreshold),
+		NMSMethod:           nmsMethod,
+		SoftNMSSigma:        float32(softNMSSigma),
+		MaxDetections:       maxDetections,
+		AllowedClasses:      allowedClasses,
+	}
+	var objects *tracker
+	if trackObjects {
+		objects = newTracker(&TrackerOptions{
+			HighThreshold:     detectionOptions.ConfidenceThreshold,
+			LowThreshold:      float32(trackLowConfidence),
+			MatchIoUThreshold: float32(trackIoU),
+			MaxAge:            trackMaxAge,
+			MinHits:           trackMinHits,
+		})
+		// The tracker needs to see the low-confidence boxes, too.
+		detectionOptions.ConfidenceThreshold = min(
+			detectionOptions.ConfidenceThreshold, float32(trackLowConfidence))
+	}
+	d := &detector{
+		session:            modelSession,
+		options:            detectionOptions,
+		letterbox:          !stretchInput,
+		tileSize:           tileSize,
+		tileOverlap:        tileOverlap,
+		tileMergeThreshold: float32(tileMergeThreshold),
+		timing:             benchmark.NewTimer(),
+	}
+
+	if evalAnnotations != "" {
+		return runEvaluation(d, evalAnnotations, evalImageDir,
+			evalPRCurvesPath, evalMinMAP50, evalMinMAP)
+	}
 
-		timingStats.Start()
-		e = modelSession.Session.Run()
+	var crops *cropWriter
+	if cropDir != "" {
+		crops, e = newCropWriter(cropDir, cropPadding, cropMinSize)
 		if e != nil {
-			fmt.Printf("Error running ORT session: %s\n", e)
+			fmt.Printf("Error setting up crop output: %s\n", e)
 			return 1
 		}
-		timingStats.Finish()
+	}
 
-		// Print the results
-		boxes := processOutput(modelSession.Output.GetData(), originalWidth,
-			originalHeight)
-		for i, box := range boxes {
-			fmt.Printf("Box %d: %s\n", i, &box)
+	if batchMode {
+		var imageWriters []imageWriter
+		if outputImageDir != "" {
+			w, e := newAnnotatedImageWriter(outputImageDir)
+			if e != nil {
+				fmt.Printf("Error setting up annotated image output: %s\n", e)
+				return 1
+			}
+			imageWriters = append(imageWriters, w)
+		}
+		if redactedImageDir != "" {
+			w, e := newRedactedImageWriter(redactedImageDir, redaction)
+			if e != nil {
+				fmt.Printf("Error setting up redacted image output: %s\n", e)
+				return 1
+			}
+			imageWriters = append(imageWriters, w)
+		}
+		if crops != nil {
+			imageWriters = append(imageWriters, crops)
+		}
+		var animation *animatedGIFWriter
+		if outputGIFPath != "" {
+			animation = newAnimatedGIFWriter(outputGIFPath, gifDelays,
+				100/outputGIFFPS)
+			imageWriters = append(imageWriters, animation)
+		}
+		summary := processImages(d, frames, maxFrames, detections,
+			imageWriters, objects, quiet)
+		e = detections.Close()
+		if e != nil {
+			fmt.Printf("Error writing detections: %s\n", e)
+			return 1
+		}
+		if crops != nil {
+			e = crops.Close()
+			if e != nil {
+				fmt.Printf("Error saving crops: %s\n", e)
+				return 1
+			}
 		}
+		if animation != nil {
+			e = animation.Close()
+			if e != nil {
+				fmt.Printf("Error saving animated GIF: %s\n", e)
+				return 1
+			}
+			if !quiet {
+				fmt.Printf("Saved animated GIF to %s\n", outputGIFPath)
+			}
+		}
+		// Each batch counts as one run when reporting timing statistics.
+		var timingOutput io.Writer
+		if !quiet {
+			timingOutput = os.Stdout
+		}
+		e = benchmarkConfig.Report(d.timing.Result(filepath.Base(modelPath)),
+			timingOutput)
+		if e != nil {
+			fmt.Printf("Error writing timing statistics: %s\n", e)
+			return 1
+		}
+		if !quiet {
+			summary.Print(os.Stdout)
+		}
+		if summary.imagesFailed != 0 {
+			return 1
+		}
+		return 0
 	}
-	timingStats.PrintStats()
-	return 0
-}
 
-func loadImageFile(filePath string) (image.Image, error) {
-	f, e := os.Open(filePath)
+	// Read the input image into a image.Image object
+	pic, e := loadImageFile(inputImagePath)
 	if e != nil {
-		return nil, fmt.Errorf("Error opening %s: %w", filePath, e)
+		fmt.Printf("Error loading input image: %s\n", e)
+		return 1
+	}
+
+	var boxes []boundingBox
+	var transform *inputTransform
+	detectOnce := func() error {
+		var e error
+		boxes, transform, e = d.detect(pic)
+		return e
 	}
-	defer f.Close()
-	pic, _, e := image.Decode(f)
+	e = detectOnce()
 	if e != nil {
-		return nil, fmt.Errorf("Error decoding %s: %w", filePath, e)
+		fmt.Printf("Error running detection: %s\n", e)
+		return 1
+	}
+	if benchmarkConfig.Enabled() {
+		result, e := benchmarkConfig.Run(filepath.Base(modelPath), d.timing,
+			1, detectOnce)
+		if e != nil {
+			fmt.Printf("Error running benchmark: %s\n", e)
+			return 1
+		}
+		var timingOutput io.Writer
+		if !quiet {
+			timingOutput = os.Stdout
+		}
+		e = benchmarkConfig.Report(result, timingOutput)
+		if e != nil {
+			fmt.Printf("Error writing benchmark results: %s\n", e)
+			return 1
+		}
 	}
-	return pic, nil
-}
 
-// Populates a yolov8n input tensor with the contents of the given image.
-func prepareInput(pic image.Image, dst *ort.Tensor[float32]) error {
-	data := dst.GetData()
-	channelSize := 640 * 640
-	if len(data) < (channelSize * 3) {
-		return fmt.Errorf("Destination tensor only holds %d floats, needs "+
-			"%d (make sure it's the right shape!)", len(data), channelSize*3)
+	// Report the results
+	e = detections.WriteDetections(1, inputImagePath,
+		transform.originalWidth, transform.originalHeight, boxes)
+	if e == nil {
+		e = detections.Close()
+	}
+	if e != nil {
+		fmt.Printf("Error writing detections: %s\n", e)
+		return 1
+	}
+
+	if outputImagePath != "" {
+		e = saveImage(drawDetections(pic, boxes), outputImagePath)
+		if e != nil {
+			fmt.Printf("Error saving output image: %s\n", e)
+			return 1
+		}
+		if !quiet {
+			fmt.Printf("Saved annotated image to %s\n", outputImagePath)
+		}
 	}
-	redChannel := data[0:channelSize]
-	greenChannel := data[channelSize : channelSize*2]
-	blueChannel := data[channelSize*2 : channelSize*3]
+	if redactedImagePath != "" {
+		e = saveImage(redaction.redact(pic, boxes), redactedImagePath)
+		if e != nil {
+			fmt.Printf("Error saving redacted image: %s\n", e)
+			return 1
+		}
+		if !quiet {
+			fmt.Printf("Saved redacted image to %s\n", redactedImagePath)
+		}
+	}
+	if crops != nil {
+		e = crops.WriteImage(1, inputImagePath, pic, boxes)
+		if e == nil {
+			e = crops.Close()
+		}
+		if e != nil {
+			fmt.Printf("Error saving crops: %s\n", e)
+			return 1
+		}
+		if !quiet {
+			fmt.Printf("Saved crops to %s\n", cropDir)
+		}
+	}
+	if maskOverlayPath != "" {
+		e = saveImage(drawMaskOverlay(pic, boxes), maskOverlayPath)
+		if e != nil {
+			fmt.Printf("Error saving mask overlay: %s\n", e)
+			return 1
+		}
+		if !quiet {
+			fmt.Printf("Saved mask overlay to %s\n", maskOverlayPath)
+		}
+	}
+	return 0
+}
 
-	// Resize the image to 640x640 using Lanczos3 algorithm
-	pic = resize.Resize(640, 640, pic, resize.Lanczos3)
-	i := 0
-	for y := 0; y < 640; y++ {
-		for x := 0; x < 640; x++ {
-			r, g, b, _ := pic.At(x, y).RGBA()
-			redChannel[i] = float32(r>>8) / 255.0
-			greenChannel[i] = float32(g>>8) / 255.0
-			blueChannel[i] = float32(b>>8) / 255.0
-			i++
+// Evaluates the detector against the COCO-format annotations at the given
+// path, printing the results and optionally writing the precision/recall
+// curves to prCurvesPath. Returns the program's exit code, which is nonzero
+// if either mAP is below the given minimum.
+func runEvaluation(d *detector, annotationsPath, imageDir,
+	prCurvesPath string, minMAP50, minMAP float64) int {
+	dataset, e := loadCOCODataset(annotationsPath)
+	if e != nil {
+		fmt.Printf("Error loading annotations: %s\n", e)
+		return 1
+	}
+	if imageDir == "" {
+		imageDir = filepath.Dir(annotationsPath)
+	}
+	result := evaluateDataset(d, dataset, imageDir, false)
+	result.Print(os.Stdout)
+	if prCurvesPath != "" {
+		e = result.writePRCurves(prCurvesPath)
+		if e != nil {
+			fmt.Printf("Error saving precision/recall curves: %s\n", e)
+			return 1
 		}
 	}
+	if result.imagesFailed != 0 {
+		return 1
+	}
+	map50, mapAll := result.meanAP()
+	if map50 < minMAP50 {
+		fmt.Printf("mAP@0.5 of %.4f is below the minimum of %.4f\n", map50,
+			minMAP50)
+		return 1
+	}
+	if mapAll < minMAP {
+		fmt.Printf("mAP@0.5:0.95 of %.4f is below the minimum of %.4f\n",
+			mapAll, minMAP)
+		return 1
+	}
+	return 0
+}
 
+// Chooses the labels used for each class, and checks that their number
+// matches the number of classes output by the session's network. If
+// fromFile is set, classLabels has already been loaded from a file.
+// Otherwise, the labels are read from the network's metadata if it contains
+// them, falling back to the labels of the dataset the stock networks for the
+// session's task were trained on. A mismatch with the fallback labels is only
+// a warning, since extra classes are still reported using placeholder names.
+func setupClassLabels(session *ModelSession, fromFile, quiet bool) error {
+	numClasses := session.NumClasses()
+	if fromFile {
+		return validateClassLabels(classLabels, numClasses)
+	}
+	labels, e := loadModelClassLabels(modelPath)
+	if e != nil {
+		return e
+	}
+	if labels != nil {
+		classLabels = labels
+		return validateClassLabels(classLabels, numClasses)
+	}
+	if session.Task == taskOBB {
+		// The stock OBB networks are trained on the DOTA dataset rather than
+		// COCO.
+		classLabels = dotaClasses
+	}
+	e = validateClassLabels(classLabels, numClasses)
+	if (e != nil) && !quiet {
+		fmt.Printf("Warning: %s. Use -labels to provide the class names.\n",
+			e)
+	}
 	return nil
 }
 
-func getSharedLibPath() string {
-	if runtime.GOOS == "windows" {
-		if runtime.GOARCH == "amd64" {
-			return "../third_party/onnxruntime.dll"
-		}
+// Bundles a ModelSession with the settings used to convert its output into
+// boxes, so that the same session can be reused for any number of images.
+type detector struct {
+	session   *ModelSession
+	options   *DetectionOptions
+	letterbox bool
+	// If positive, images are split into tiles of this size, overlapping by
+	// the tileOverlap fraction, before running the network. See detectTiled.
+	tileSize    int
+	tileOverlap float64
+	// Boxes from different tiles are merged if their intersection over the
+	// smaller box's area exceeds this. See mergeTileBoxes.
+	tileMergeThreshold float32
+	// Records how long each stage of processing takes. Runs are finished by
+	// the detector's callers, since one image may require several batches
+	// when tiling, or one batch may contain several images.
+	timing *benchmark.Timer
+}
+
+// Returns the number of images the detector's session processes at once.
+func (d *detector) batchSize() int {
+	return int(d.session.Input.GetShape()[0])
+}
+
+// Returns the number of images that should be passed to each call to
+// detectImages. This is the batch size, unless tiling is enabled, in which
+// case the batch is instead filled with tiles from a single image.
+func (d *detector) imagesPerBatch() int {
+	if d.tileSize > 0 {
+		return 1
+	}
+	return d.batchSize()
+}
+
+// Runs the network on a single image, returning the boxes found in it along
+// with the transform used to map the network's input back to the image.
+func (d *detector) detect(pic image.Image) ([]boundingBox, *inputTransform,
+	error) {
+	boxes, transforms, e := d.detectImages([]image.Image{pic})
+	if e != nil {
+		return nil, nil, e
 	}
-	if runtime.GOOS == "darwin" {
-		if runtime.GOARCH == "arm64" {
-			return "../third_party/onnxruntime_arm64.dylib"
+	return boxes[0], transforms[0], nil
+}
+
+// Like detectBatch, but splits each image into tiles if tiling is enabled.
+// Accepts up to imagesPerBatch() images.
+func (d *detector) detectImages(pics []image.Image) ([][]boundingBox,
+	[]*inputTransform, error) {
+	if d.tileSize <= 0 {
+		return d.detectBatch(pics)
+	}
+	allBoxes := make([][]boundingBox, len(pics))
+	transforms := make([]*inputTransform, len(pics))
+	for i, pic := range pics {
+		boxes, transform, e := d.detectTiled(pic)
+		if e != nil {
+			return nil, nil, e
 		}
-		if runtime.GOARCH == "amd64" {
-			return "../third_party/onnxruntime_amd64.dylib"
+		allBoxes[i] = boxes
+		transforms[i] = transform
+	}
+	return allBoxes, transforms, nil
+}
+
+// Runs the network on up to batchSize() images at once, returning the boxes
+// found in each image along with the transforms used to map the network's
+// input back to each image. If there are fewer images than the batch size,
+// the remaining batch slots are zeroed and their output is ignored.
+func (d *detector) detectBatch(pics []image.Image) ([][]boundingBox,
+	[]*inputTransform, error) {
+	batchSize := d.batchSize()
+	if (len(pics) == 0) || (len(pics) > batchSize) {
+		return nil, nil, fmt.Errorf("Can't process %d images with a batch "+
+			"size of %d", len(pics), batchSize)
+	}
+	d.timing.Stage(benchmark.Preprocess)
+	transforms := make([]*inputTransform, len(pics))
+	for i, pic := range pics {
+		transform, e := prepareInput(pic, d.session.Input, i, d.letterbox)
+		if e != nil {
+			return nil, nil, fmt.Errorf("Error converting image %d to "+
+				"network input: %w", i, e)
 		}
+		transforms[i] = transform
+	}
+	if len(pics) < batchSize {
+		inputData := d.session.Input.GetData()
+		imageSize := len(inputData) / batchSize
+		clear(inputData[len(pics)*imageSize:])
+	}
 
+	d.timing.Stage(benchmark.Inference)
+	e := d.session.Session.Run()
+	if e != nil {
+		return nil, nil, fmt.Errorf("Error running ORT session: %w", e)
 	}
-	if runtime.GOOS == "linux" {
-		if runtime.GOARCH == "arm64" {
-			return "../third_party/onnxruntime_arm64.so"
+	d.timing.Stage(benchmark.Postprocess)
+
+	// Process each image's slice of the output as if it were a batch of 1.
+	outputShape := d.session.Output.GetShape()
+	imageOutputShape := ort.NewShape(1, outputShape[1], outputShape[2])
+	imageOutputSize := int(imageOutputShape.FlattenedSize())
+	outputData := d.session.Output.GetData()
+	toReturn := make([][]boundingBox, len(pics))
+	for i := range pics {
+		imageOutput := outputData[i*imageOutputSize : (i+1)*imageOutputSize]
+		var boxes []boundingBox
+		switch d.session.Task {
+		case taskSegment:
+			protoShape := d.session.MaskProtos.GetShape()
+			imageProtoShape := ort.NewShape(1, protoShape[1], protoShape[2],
+				protoShape[3])
+			imageProtoSize := int(imageProtoShape.FlattenedSize())
+			protos := d.session.MaskProtos.GetData()
+			protos = protos[i*imageProtoSize : (i+1)*imageProtoSize]
+			boxes, e = processSegmentationOutput(imageOutput, imageOutputShape,
+				protos, imageProtoShape, transforms[i], d.options)
+		case taskPose:
+			boxes, e = processPoseOutput(imageOutput, imageOutputShape,
+				transforms[i], d.options)
+		case taskOBB:
+			boxes, e = processOBBOutput(imageOutput, imageOutputShape,
+				transforms[i], d.options)
+		default:
+			boxes, e = d.session.Decoder.Decode(imageOutput,
+				imageOutputShape, transforms[i], d.options)
 		}
-		return "../third_party/onnxruntime.so"
+		if e != nil {
+			return nil, nil, fmt.Errorf("Error processing network output "+
+				"for image %d: %w", i, e)
+		}
+		toReturn[i] = boxes
 	}
-	panic("Unable to find a version of the onnxruntime library supporting this system.")
+	return toReturn, transforms, nil
+}
+
+// Loads an input image, rotating it according to its EXIF orientation and
+// compositing any transparent pixels onto imageBackground.
+func loadImageFile(filePath string) (image.Image, error) {
+	return imageutil.Load(filePath, imageBackground)
 }
 
-func initSession() (*ModelSession, error) {
-	ort.SetSharedLibraryPath(getSharedLibPath())
-	err := ort.InitializeEnvironment()
+// Initializes onnxruntime and creates a session with tensors able to hold
+// batchSize images at a time. A batch size greater than 1 requires a network
+// exported with a dynamic batch dimension, or with a fixed batch dimension
+// matching batchSize. The task determines which outputs the session expects.
+// The decoder name is one of the names accepted by getDecoder, or "auto" to
+// choose a decoder based on the network's output shape. libPath is the value
+// of the -onnxruntime_lib flag, which may be empty; see the ortlib package.
+func initSession(libPath string, batchSize int, task modelTask,
+	decoderName string,
+	sessionConfig *sessionopts.Config) (*ModelSession, error) {
+	if batchSize < 1 {
+		return nil, fmt.Errorf("Invalid batch size: %d", batchSize)
+	}
+	var decoder outputDecoder
+	var err error
+	if decoderName != "auto" {
+		decoder, err = getDecoder(decoderName)
+		if err != nil {
+			return nil, err
+		}
+		if (task != taskDetect) && (decoder.Name() != "v8") {
+			return nil, fmt.Errorf("The %s task only supports YOLOv8-style "+
+				"output, not the %s decoder", task, decoderName)
+		}
+	}
+	_, err = ortlib.Initialize(libPath)
 	if err != nil {
 		return nil, fmt.Errorf("Error initializing ORT environment: %w", err)
 	}
 
-	inputShape := ort.NewShape(1, 3, 640, 640)
+	// The input size, number of classes and number of anchors depend on how
+	// the network was trained and exported, so we ask onnxruntime rather than
+	// assuming the 3x640x640 input and 84x8400 output of the stock yolov8n
+	// network.
+	inputs, outputs, err := ort.GetInputOutputInfo(modelPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting inputs and outputs of %s: %w",
+			modelPath, err)
+	}
+	inputShape, err := getTensorShape(inputs, "images", 4, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	outputShape, err := getTensorShape(outputs, "output0", 3, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	if task != taskDetect {
+		decoder = yoloV8Decoder{}
+	} else if decoder == nil {
+		decoder, err = detectDecoder(outputShape)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	inputTensor, err := ort.NewEmptyTensor[float32](inputShape)
 	if err != nil {
 		return nil, fmt.Errorf("Error creating input tensor: %w", err)
 	}
-	outputShape := ort.NewShape(1, 84, 8400)
 	outputTensor, err := ort.NewEmptyTensor[float32](outputShape)
 	if err != nil {
 		inputTensor.Destroy()
 		return nil, fmt.Errorf("Error creating output tensor: %w", err)
 	}
-	options, err := ort.NewSessionOptions()
-	if err != nil {
-		inputTensor.Destroy()
-		outputTensor.Destroy()
-		return nil, fmt.Errorf("Error creating ORT session options: %w", err)
+	toReturn := &ModelSession{
+		Input:   inputTensor,
+		Output:  outputTensor,
+		Task:    task,
+		Decoder: decoder,
 	}
-	defer options.Destroy()
+	outputNames := []string{"output0"}
+	outputTensors := []ort.ArbitraryTensor{outputTensor}
 
-	// If CoreML is enabled, append the CoreML execution provider
-	if useCoreML {
-		err = options.AppendExecutionProviderCoreML(0)
+	// Segmentation networks have a second output holding the prototype masks,
+	// with shape N x (number of masks) x (mask height) x (mask width).
+	if task == taskSegment {
+		protoShape, err := getTensorShape(outputs, "output1", 4, batchSize)
 		if err != nil {
-			inputTensor.Destroy()
-			outputTensor.Destroy()
-			return nil, fmt.Errorf("Error enabling CoreML: %w", err)
+			toReturn.Destroy()
+			return nil, err
 		}
+		toReturn.MaskProtos, err = ort.NewEmptyTensor[float32](protoShape)
+		if err != nil {
+			toReturn.Destroy()
+			return nil, fmt.Errorf("Error creating mask output tensor: %w",
+				err)
+		}
+		outputNames = append(outputNames, "output1")
+		outputTensors = append(outputTensors, toReturn.MaskProtos)
 	}
 
-	session, err := ort.NewAdvancedSession(modelPath,
-		[]string{"images"}, []string{"output0"},
-		[]ort.ArbitraryTensor{inputTensor},
-		[]ort.ArbitraryTensor{outputTensor},
-		options)
+	options, pathToLoad, err := sessionConfig.NewSessionOptions(modelPath)
 	if err != nil {
-		inputTensor.Destroy()
-		outputTensor.Destroy()
+		toReturn.Destroy()
+		return nil, fmt.Errorf("Error creating ORT session options: %w", err)
+	}
+	defer options.Destroy()
+
+	toReturn.Session, err = ort.NewAdvancedSession(pathToLoad,
+		[]string{"images"}, outputNames,
+		[]ort.ArbitraryTensor{inputTensor}, outputTensors, options)
+	if err != nil {
+		toReturn.Destroy()
 		return nil, fmt.Errorf("Error creating ORT session: %w", err)
 	}
+	return toReturn, nil
+}
 
-	return &ModelSession{
-		Session: session,
-		Input:   inputTensor,
-		Output:  outputTensor,
-	}, nil
+// Looks up the shape of the named input or output in infos, which must have
+// the given number of dimensions. A dynamic batch dimension is replaced with
+// batchSize, and a fixed batch dimension must equal batchSize. Any other
+// dynamic dimension results in an error.
+func getTensorShape(infos []ort.InputOutputInfo, name string,
+	dimensions, batchSize int) (ort.Shape, error) {
+	for _, info := range infos {
+		if info.Name != name {
+			continue
+		}
+		shape := info.Dimensions.Clone()
+		if len(shape) != dimensions {
+			return nil, fmt.Errorf("Expected %s to have %d dimensions, got %s",
+				name, dimensions, shape)
+		}
+		if shape[0] < 0 {
+			shape[0] = int64(batchSize)
+		} else if shape[0] != int64(batchSize) {
+			return nil, fmt.Errorf("The network was exported with a fixed "+
+				"batch size of %d, so it can't be used with a batch size of "+
+				"%d. (Re-export it with a dynamic batch dimension.)",
+				shape[0], batchSize)
+		}
+		if e := shape.Validate(); e != nil {
+			return nil, fmt.Errorf("%s has an unsupported shape: %w", name, e)
+		}
+		return shape, nil
+	}
+	return nil, fmt.Errorf("The network has no input or output named %s",
+		name)
 }
 
+// Destroys the session and any tensors that have been created. Safe to call
+// on a partially-initialized ModelSession.
 func (m *ModelSession) Destroy() {
-	m.Session.Destroy()
+	if m.Session != nil {
+		m.Session.Destroy()
+	}
 	m.Input.Destroy()
 	m.Output.Destroy()
+	if m.MaskProtos != nil {
+		m.MaskProtos.Destroy()
+	}
+}
+
+// Returns the number of classes predicted by the session's network, or -1 if
+// it can't be determined from the network's output shape.
+func (m *ModelSession) NumClasses() int {
+	numExtra := 0
+	switch m.Task {
+	case taskSegment:
+		numExtra = int(m.MaskProtos.GetShape()[1])
+	case taskPose:
+		numExtra = numPoseKeypoints * poseKeypointWidth
+	case taskOBB:
+		numExtra = 1
+	}
+	return m.Decoder.NumClasses(m.Output.GetShape(), numExtra)
 }
 
 type boundingBox struct {
 	label          string
+	classID        int
 	confidence     float32
 	x1, y1, x2, y2 float32
+	// Only set when using a segmentation network. The mask coefficients are
+	// combined with the network's prototype masks to produce the mask, which
+	// covers the box's area of the original image. Pixels belonging to the
+	// object have an alpha of 0xff, and all others are 0.
+	maskCoefficients []float32
+	mask             *image.Alpha
+	// Only set when using a pose network.
+	keypoints []keypoint
+	// Only set when using an OBB network. Holds the four corners of the
+	// rotated box, in order around its perimeter.
+	corners []point
+	// Only set when tracking objects across frames. Boxes belonging to the
+	// same object have the same track ID. Zero if the box isn't tracked.
+	trackID int
 }
 
 func (b *boundingBox) String() string {
@@ -222,101 +1156,222 @@ func (b *boundingBox) toRect() image.Rectangle {
 	return image.Rect(int(b.x1), int(b.y1), int(b.x2), int(b.y2)).Canon()
 }
 
-// Returns the area of b in pixels, after converting to an image.Rectangle.
-func (b *boundingBox) rectArea() int {
-	size := b.toRect().Size()
-	return size.X * size.Y
+// Returns the area of b in (possibly fractional) pixels.
+func (b *boundingBox) area() float32 {
+	w, h := b.x2-b.x1, b.y2-b.y1
+	if (w <= 0) || (h <= 0) {
+		return 0
+	}
+	return w * h
 }
 
+// Returns the area of the overlap between b and other.
 func (b *boundingBox) intersection(other *boundingBox) float32 {
-	r1 := b.toRect()
-	r2 := other.toRect()
-	intersected := r1.Intersect(r2).Canon().Size()
-	return float32(intersected.X * intersected.Y)
+	x1, y1 := max(b.x1, other.x1), max(b.y1, other.y1)
+	x2, y2 := min(b.x2, other.x2), min(b.y2, other.y2)
+	if (x2 <= x1) || (y2 <= y1) {
+		return 0
+	}
+	return (x2 - x1) * (y2 - y1)
 }
 
 func (b *boundingBox) union(other *boundingBox) float32 {
-	intersectArea := b.intersection(other)
-	totalArea := float32(b.rectArea() + other.rectArea())
-	return totalArea - intersectArea
+	return b.area() + other.area() - b.intersection(other)
 }
 
-// This won't be entirely precise due to conversion to the integral rectangles
-// from the image.Image library, but we're only using it to estimate which
-// boxes are overlapping too much, so some imprecision should be OK.
+// Returns the intersection-over-union of b and other. Unlike toRect, this
+// uses the boxes' exact floating-point coordinates, so small boxes aren't
+// affected by rounding. If both boxes are rotated, this returns the IoU of
+// the rotated boxes.
 func (b *boundingBox) iou(other *boundingBox) float32 {
-	return b.intersection(other) / b.union(other)
+	if (len(b.corners) == 4) && (len(other.corners) == 4) {
+		return rotatedIoU(b.corners, other.corners)
+	}
+	u := b.union(other)
+	if u <= 0 {
+		return 0
+	}
+	return b.intersection(other) / u
 }
 
-func processOutput(output []float32, originalWidth,
-	originalHeight int) []boundingBox {
-	boundingBoxes := make([]boundingBox, 0, 8400)
+// Controls which of the network's candidate boxes are reported by
+// processOutput.
+type DetectionOptions struct {
+	// Candidates with a class probability below this are discarded.
+	ConfidenceThreshold float32
+	// A candidate is discarded if its IoU with an already-accepted box
+	// exceeds this. Ignored when using soft-NMS.
+	IoUThreshold float32
+	// Determines how overlapping boxes are suppressed.
+	NMSMethod NMSMethod
+	// The standard deviation of the Gaussian used to decay scores when
+	// NMSMethod is NMSSoftGaussian.
+	SoftNMSSigma float32
+	// The maximum number of boxes to return. Zero or negative means there's
+	// no limit.
+	MaxDetections int
+	// If non-nil, only boxes with class IDs in this set are returned.
+	AllowedClasses map[int]bool
+}
+
+// Returns the DetectionOptions matching the thresholds this example has
+// always used.
+func DefaultDetectionOptions() *DetectionOptions {
+	return &DetectionOptions{
+		ConfidenceThreshold: 0.5,
+		IoUThreshold:        0.7,
+		NMSMethod:           NMSClassAware,
+		SoftNMSSigma:        0.5,
+	}
+}
+
+// Parses a comma-separated list of class names or numeric class IDs into a
+// set of class IDs. Returns a nil map if the list is empty.
+func parseClassList(list string) (map[int]bool, error) {
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return nil, nil
+	}
+	toReturn := make(map[int]bool)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, e := strconv.Atoi(entry)
+		if e == nil {
+			if id < 0 {
+				return nil, fmt.Errorf("Invalid class ID: %d", id)
+			}
+			toReturn[id] = true
+			continue
+		}
+		found := false
+		for i, name := range classLabels {
+			if name == entry {
+				toReturn[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown class name: %q", entry)
+		}
+	}
+	return toReturn, nil
+}
+
+// Returns the label for the given class ID, or a placeholder if the network
+// has more classes than we have labels for.
+func classLabel(classID int) string {
+	if (classID < 0) || (classID >= len(classLabels)) {
+		return fmt.Sprintf("class %d", classID)
+	}
+	return classLabels[classID]
+}
+
+// Converts the network's output into a list of bounding boxes in the original
+// image's coordinates, sorted in order of decreasing confidence. The
+// transform must be the one returned by prepareInput. The output must be in
+// the YOLOv8 layout, with shape 1 x (4 + number of classes) x (number of
+// anchors). The first four rows hold each anchor's center X, center Y, width,
+// and height, and the remaining rows hold each anchor's class probabilities.
+// Overlapping boxes are removed using nonMaxSuppression.
+func processOutput(output []float32, outputShape ort.Shape,
+	transform *inputTransform, opts *DetectionOptions) ([]boundingBox, error) {
+	if opts == nil {
+		opts = DefaultDetectionOptions()
+	}
+	boundingBoxes, e := decodeYOLOv8Candidates(output, outputShape, 0,
+		transform, opts, nil)
+	if e != nil {
+		return nil, e
+	}
+	return nonMaxSuppression(boundingBoxes, opts), nil
+}
+
+// Decodes every box in a YOLOv8-layout output that passes the confidence
+// threshold and class filter in opts, without removing overlapping boxes. The
+// output's rows hold the four box coordinates, followed by the class
+// probabilities, followed by numExtra rows of additional per-anchor data
+// (e.g., mask coefficients). If extra is non-nil, it's called for each
+// decoded box with the box's center X, center Y, width and height in the
+// network's input coordinates, and a newly allocated slice holding the extra
+// rows' values for the box's anchor.
+func decodeYOLOv8Candidates(output []float32, outputShape ort.Shape,
+	numExtra int, transform *inputTransform, opts *DetectionOptions,
+	extra func(box *boundingBox, xywh [4]float32,
+		values []float32)) ([]boundingBox, error) {
+	if (len(outputShape) != 3) || (outputShape[1] <= int64(4+numExtra)) {
+		return nil, fmt.Errorf("Invalid YOLOv8 output shape: %s", outputShape)
+	}
+	numRows := int(outputShape[1])
+	numClasses := numRows - 4 - numExtra
+	numAnchors := int(outputShape[2])
+	if len(output) < (numAnchors * numRows) {
+		return nil, fmt.Errorf("Output only contains %d floats, expected "+
+			"at least %d for shape %s", len(output), numAnchors*numRows,
+			outputShape)
+	}
+	boundingBoxes := make([]boundingBox, 0, numAnchors)
 
 	var classID int
 	var probability float32
 
-	// Iterate through the output array, considering 8400 indices
-	for idx := 0; idx < 8400; idx++ {
-		// Iterate through 80 classes and find the class with the highest probability
+	// Iterate through the output array, considering each anchor
+	for idx := 0; idx < numAnchors; idx++ {
+		// Find the class with the highest probability, ignoring any classes
+		// we weren't asked to report.
 		probability = -1e9
-		for col := 0; col < 80; col++ {
-			currentProb := output[8400*(col+4)+idx]
+		classID = -1
+		for col := 0; col < numClasses; col++ {
+			if (opts.AllowedClasses != nil) && !opts.AllowedClasses[col] {
+				continue
+			}
+			currentProb := output[numAnchors*(col+4)+idx]
 			if currentProb > probability {
 				probability = currentProb
 				classID = col
 			}
 		}
 
-		// If the probability is less than 0.5, continue to the next index
-		if probability < 0.5 {
+		// If the probability is too low, continue to the next index
+		if (classID < 0) || (probability < opts.ConfidenceThreshold) {
 			continue
 		}
 
 		// Extract the coordinates and dimensions of the bounding box
-		xc, yc := output[idx], output[8400+idx]
-		w, h := output[2*8400+idx], output[3*8400+idx]
-		x1 := (xc - w/2) / 640 * float32(originalWidth)
-		y1 := (yc - h/2) / 640 * float32(originalHeight)
-		x2 := (xc + w/2) / 640 * float32(originalWidth)
-		y2 := (yc + h/2) / 640 * float32(originalHeight)
+		xc, yc := output[idx], output[numAnchors+idx]
+		w, h := output[2*numAnchors+idx], output[3*numAnchors+idx]
+		x1, y1 := transform.toOriginal(xc-w/2, yc-h/2)
+		x2, y2 := transform.toOriginal(xc+w/2, yc+h/2)
 
 		// Append the bounding box to the result
 		boundingBoxes = append(boundingBoxes, boundingBox{
-			label:      yoloClasses[classID],
+			label:      classLabel(classID),
+			classID:    classID,
 			confidence: probability,
 			x1:         x1,
 			y1:         y1,
 			x2:         x2,
 			y2:         y2,
 		})
-	}
-
-	// Sort the bounding boxes by probability
-	sort.Slice(boundingBoxes, func(i, j int) bool {
-		return boundingBoxes[i].confidence < boundingBoxes[j].confidence
-	})
-
-	// Define a slice to hold the final result
-	mergedResults := make([]boundingBox, 0, len(boundingBoxes))
-
-	// Iterate through sorted bounding boxes, removing overlaps
-	for _, candidateBox := range boundingBoxes {
-		overlapsExistingBox := false
-		for _, existingBox := range mergedResults {
-			if (&candidateBox).iou(&existingBox) > 0.7 {
-				overlapsExistingBox = true
-				break
+		if extra != nil {
+			values := make([]float32, numExtra)
+			for i := range values {
+				values[i] = output[numAnchors*(4+numClasses+i)+idx]
 			}
-		}
-		if !overlapsExistingBox {
-			mergedResults = append(mergedResults, candidateBox)
+			extra(&(boundingBoxes[len(boundingBoxes)-1]),
+				[4]float32{xc, yc, w, h}, values)
 		}
 	}
-
-	// This will still be in sorted order by confidence
-	return mergedResults
+	return boundingBoxes, nil
 }
 
+// The labels for each class ID output by the network. Defaults to the COCO
+// labels used by the stock YOLOv8 networks.
+var classLabels = yoloClasses
+
 // Array of YOLOv8 class labels
 var yoloClasses = []string{
 	"person", "bicycle", "car", "motorcycle", "airplane", "bus", "train", "truck", "boat",
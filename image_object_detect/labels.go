@@ -0,0 +1,156 @@
+package main
+
+// This file contains the code for loading the labels of each class ID output
+// by the network, for networks that weren't trained on the COCO classes.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	ort "github.com/yalue/onnxruntime_go"
+	"gopkg.in/yaml.v3"
+)
+
+// Loads class labels from a file. Files ending in .yaml or .yml are treated as
+// Ultralytics dataset files, and the labels are read from their "names" entry.
+// Any other file is treated as a text file containing one label per line, in
+// order of class ID. Blank lines in text files are ignored.
+func loadClassLabels(path string) ([]string, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if (ext == ".yaml") || (ext == ".yml") {
+		data, e := os.ReadFile(path)
+		if e != nil {
+			return nil, fmt.Errorf("Error reading %s: %w", path, e)
+		}
+		var dataset struct {
+			Names any `yaml:"names"`
+		}
+		e = yaml.Unmarshal(data, &dataset)
+		if e != nil {
+			return nil, fmt.Errorf("Error parsing %s: %w", path, e)
+		}
+		if dataset.Names == nil {
+			return nil, fmt.Errorf("%s doesn't contain a names entry", path)
+		}
+		labels, e := parseYAMLNames(dataset.Names)
+		if e != nil {
+			return nil, fmt.Errorf("Invalid names in %s: %w", path, e)
+		}
+		return labels, nil
+	}
+
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, fmt.Errorf("Error opening %s: %w", path, e)
+	}
+	defer f.Close()
+	var toReturn []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		label := strings.TrimSpace(scanner.Text())
+		if label == "" {
+			continue
+		}
+		toReturn = append(toReturn, label)
+	}
+	if e = scanner.Err(); e != nil {
+		return nil, fmt.Errorf("Error reading %s: %w", path, e)
+	}
+	if len(toReturn) == 0 {
+		return nil, fmt.Errorf("%s doesn't contain any labels", path)
+	}
+	return toReturn, nil
+}
+
+// Loads class labels from the "names" entry in the model's metadata, which is
+// added by the Ultralytics python package when exporting networks to ONNX.
+// Returns a nil slice if the model doesn't contain the entry. Requires the
+// onnxruntime environment to be initialized.
+func loadModelClassLabels(modelPath string) ([]string, error) {
+	metadata, e := ort.GetModelMetadata(modelPath)
+	if e != nil {
+		return nil, fmt.Errorf("Error reading metadata of %s: %w", modelPath,
+			e)
+	}
+	defer metadata.Destroy()
+	value, present, e := metadata.LookupCustomMetadataMap("names")
+	if e != nil {
+		return nil, fmt.Errorf("Error looking up class names in %s: %w",
+			modelPath, e)
+	}
+	if !present {
+		return nil, nil
+	}
+	// The names are stored as a python dict, e.g. "{0: 'person', 1: 'car'}",
+	// which also happens to be valid YAML.
+	var names any
+	e = yaml.Unmarshal([]byte(value), &names)
+	if e != nil {
+		return nil, fmt.Errorf("Error parsing class names in %s: %w",
+			modelPath, e)
+	}
+	labels, e := parseYAMLNames(names)
+	if e != nil {
+		return nil, fmt.Errorf("Invalid class names in %s: %w", modelPath, e)
+	}
+	return labels, nil
+}
+
+// Converts a decoded YAML "names" value into a list of labels. Ultralytics
+// allows either a list of names, or a map from class ID to name, in which
+// case the IDs must run from 0 to the number of classes minus 1.
+func parseYAMLNames(names any) ([]string, error) {
+	switch v := names.(type) {
+	case []any:
+		toReturn := make([]string, len(v))
+		for i, name := range v {
+			toReturn[i] = fmt.Sprint(name)
+		}
+		return toReturn, nil
+	case map[string]any:
+		converted := make(map[any]any, len(v))
+		for key, name := range v {
+			converted[key] = name
+		}
+		return parseYAMLNames(converted)
+	case map[any]any:
+		byID := make(map[int]string, len(v))
+		for key, name := range v {
+			id, e := strconv.Atoi(fmt.Sprint(key))
+			if e != nil {
+				return nil, fmt.Errorf("Invalid class ID %q", fmt.Sprint(key))
+			}
+			byID[id] = fmt.Sprint(name)
+		}
+		ids := make([]int, 0, len(byID))
+		for id := range byID {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		toReturn := make([]string, len(ids))
+		for i, id := range ids {
+			if id != i {
+				return nil, fmt.Errorf("Missing a name for class ID %d", i)
+			}
+			toReturn[i] = byID[id]
+		}
+		return toReturn, nil
+	}
+	return nil, fmt.Errorf("Expected a list or map of names, got %T", names)
+}
+
+// Returns an error if the number of labels doesn't match the number of
+// classes output by the network. Does nothing if the number of classes isn't
+// known (i.e., numClasses is negative).
+func validateClassLabels(labels []string, numClasses int) error {
+	if (numClasses < 0) || (len(labels) == numClasses) {
+		return nil
+	}
+	return fmt.Errorf("Got %d class labels, but the network outputs %d "+
+		"classes", len(labels), numClasses)
+}
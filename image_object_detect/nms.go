@@ -0,0 +1,141 @@
+package main
+
+// This file contains the non-maximum suppression (NMS) algorithms used to
+// remove duplicate detections of the same object.
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Selects the algorithm used to remove overlapping boxes.
+type NMSMethod int
+
+const (
+	// Boxes only suppress other boxes with the same class. This prevents,
+	// for example, a person riding a bicycle from suppressing the bicycle.
+	NMSClassAware NMSMethod = iota
+	// Boxes suppress any overlapping box, regardless of class.
+	NMSClassAgnostic
+	// Rather than discarding overlapping boxes with the same class, their
+	// confidence is reduced according to a Gaussian of their IoU with the
+	// higher-confidence box. Boxes are only discarded once their confidence
+	// drops below the confidence threshold.
+	NMSSoftGaussian
+)
+
+func (m NMSMethod) String() string {
+	switch m {
+	case NMSClassAware:
+		return "class"
+	case NMSClassAgnostic:
+		return "agnostic"
+	case NMSSoftGaussian:
+		return "soft"
+	}
+	return fmt.Sprintf("unknown NMS method %d", int(m))
+}
+
+// Converts the name of an NMS method, as returned by NMSMethod.String(), to
+// the NMSMethod.
+func parseNMSMethod(name string) (NMSMethod, error) {
+	for _, m := range []NMSMethod{NMSClassAware, NMSClassAgnostic,
+		NMSSoftGaussian} {
+		if name == m.String() {
+			return m, nil
+		}
+	}
+	return NMSClassAware, fmt.Errorf("Unknown NMS method %q", name)
+}
+
+// Removes overlapping boxes according to opts.NMSMethod, returning the boxes
+// that remain in order of decreasing confidence, limited to
+// opts.MaxDetections. The boxes may be in any order, and the given slice is
+// not modified.
+func nonMaxSuppression(boxes []boundingBox,
+	opts *DetectionOptions) []boundingBox {
+	sorted := make([]boundingBox, len(boxes))
+	copy(sorted, boxes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].confidence > sorted[j].confidence
+	})
+
+	if opts.NMSMethod == NMSSoftGaussian {
+		return softNMS(sorted, opts)
+	}
+	classAware := opts.NMSMethod == NMSClassAware
+
+	// Define a slice to hold the final result
+	mergedResults := make([]boundingBox, 0, len(sorted))
+
+	// Iterate through sorted bounding boxes, removing overlaps
+	for _, candidateBox := range sorted {
+		if (opts.MaxDetections > 0) &&
+			(len(mergedResults) >= opts.MaxDetections) {
+			break
+		}
+		overlapsExistingBox := false
+		for _, existingBox := range mergedResults {
+			if classAware && (existingBox.classID != candidateBox.classID) {
+				continue
+			}
+			if (&candidateBox).iou(&existingBox) > opts.IoUThreshold {
+				overlapsExistingBox = true
+				break
+			}
+		}
+		if !overlapsExistingBox {
+			mergedResults = append(mergedResults, candidateBox)
+		}
+	}
+
+	// This will still be in sorted order by confidence
+	return mergedResults
+}
+
+// Implements Gaussian soft-NMS on boxes, which must already be sorted by
+// decreasing confidence. Modifies the confidences in boxes.
+func softNMS(boxes []boundingBox, opts *DetectionOptions) []boundingBox {
+	sigma := opts.SoftNMSSigma
+	if sigma <= 0 {
+		sigma = 0.5
+	}
+	toReturn := make([]boundingBox, 0, len(boxes))
+	remaining := boxes
+	for len(remaining) > 0 {
+		if (opts.MaxDetections > 0) && (len(toReturn) >= opts.MaxDetections) {
+			break
+		}
+
+		// Move the most confident remaining box to the front. The boxes
+		// start out sorted, but decaying scores may reorder them.
+		best := 0
+		for i := range remaining {
+			if remaining[i].confidence > remaining[best].confidence {
+				best = i
+			}
+		}
+		remaining[0], remaining[best] = remaining[best], remaining[0]
+		kept := remaining[0]
+		toReturn = append(toReturn, kept)
+		remaining = remaining[1:]
+
+		// Decay the scores of the boxes overlapping the one we kept, and
+		// drop any that are no longer confident enough.
+		n := 0
+		for _, b := range remaining {
+			if b.classID == kept.classID {
+				iou := (&b).iou(&kept)
+				b.confidence *= float32(math.Exp(float64(-(iou * iou) /
+					sigma)))
+			}
+			if b.confidence >= opts.ConfidenceThreshold {
+				remaining[n] = b
+				n++
+			}
+		}
+		remaining = remaining[:n]
+	}
+	return toReturn
+}
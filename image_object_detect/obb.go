@@ -0,0 +1,173 @@
+package main
+
+// This file contains the code for decoding the output of YOLOv8 oriented
+// bounding box (OBB) networks, such as yolov8n-obb.onnx, which detect rotated
+// boxes in aerial or document imagery.
+
+import (
+	"fmt"
+	"image/draw"
+	"math"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// The labels of the DOTAv1 dataset, used by the stock YOLOv8 OBB networks.
+var dotaClasses = []string{
+	"plane", "ship", "storage tank", "baseball diamond", "tennis court",
+	"basketball court", "ground track field", "harbor", "bridge",
+	"large vehicle", "small vehicle", "helicopter", "roundabout",
+	"soccer ball field", "swimming pool",
+}
+
+// A point in the original image's coordinates.
+type point struct {
+	x, y float32
+}
+
+// Like processOutput, but for OBB networks. The output's shape must be 1 x
+// (4 + number of classes + 1) x (number of anchors), where the final row holds
+// each box's rotation angle, in radians. Each returned box's corners will be
+// set, and its axis-aligned coordinates will be set to the smallest box
+// containing the corners (clipped to the image). Overlapping boxes are
+// suppressed using the IoU of the rotated boxes.
+func processOBBOutput(output []float32, outputShape ort.Shape,
+	transform *inputTransform, opts *DetectionOptions) ([]boundingBox, error) {
+	if opts == nil {
+		opts = DefaultDetectionOptions()
+	}
+	candidates, e := decodeYOLOv8Candidates(output, outputShape, 1,
+		transform, opts, func(box *boundingBox, xywh [4]float32,
+			values []float32) {
+			setRotatedCorners(box, xywh, values[0], transform)
+		})
+	if e != nil {
+		return nil, e
+	}
+	return nonMaxSuppression(candidates, opts), nil
+}
+
+// Sets box's corners to those of the rotated rectangle with the given center,
+// width and height in the network's input, rotated clockwise by angle radians
+// (in image coordinates, where Y increases downwards). Also updates the box's
+// axis-aligned coordinates to enclose the corners.
+func setRotatedCorners(box *boundingBox, xywh [4]float32, angle float32,
+	transform *inputTransform) {
+	sin, cos := math.Sincos(float64(angle))
+	cx, cy := xywh[0], xywh[1]
+	halfW, halfH := xywh[2]/2, xywh[3]/2
+	offsets := [4][2]float32{
+		{-halfW, -halfH}, {halfW, -halfH}, {halfW, halfH}, {-halfW, halfH},
+	}
+	box.corners = make([]point, 4)
+	for i, o := range offsets {
+		x := cx + o[0]*float32(cos) - o[1]*float32(sin)
+		y := cy + o[0]*float32(sin) + o[1]*float32(cos)
+		x, y = transform.toOriginalUnclipped(x, y)
+		box.corners[i] = point{x, y}
+	}
+	box.x1, box.y1 = box.corners[0].x, box.corners[0].y
+	box.x2, box.y2 = box.x1, box.y1
+	for _, p := range box.corners[1:] {
+		box.x1, box.y1 = min(box.x1, p.x), min(box.y1, p.y)
+		box.x2, box.y2 = max(box.x2, p.x), max(box.y2, p.y)
+	}
+	box.x1 = clampFloat(box.x1, 0, float32(transform.originalWidth))
+	box.x2 = clampFloat(box.x2, 0, float32(transform.originalWidth))
+	box.y1 = clampFloat(box.y1, 0, float32(transform.originalHeight))
+	box.y2 = clampFloat(box.y2, 0, float32(transform.originalHeight))
+}
+
+// Returns twice the signed area of the polygon; positive if the points are
+// in counterclockwise order (with Y increasing upwards).
+func signedArea2(polygon []point) float32 {
+	var sum float32
+	for i := range polygon {
+		a, b := polygon[i], polygon[(i+1)%len(polygon)]
+		sum += a.x*b.y - b.x*a.y
+	}
+	return sum
+}
+
+func polygonArea(polygon []point) float32 {
+	area := signedArea2(polygon) / 2
+	if area < 0 {
+		return -area
+	}
+	return area
+}
+
+// Returns the intersection of two convex polygons, computed using the
+// Sutherland-Hodgman algorithm.
+func clipConvexPolygon(subject, clip []point) []point {
+	// The inside test depends on the clip polygon's winding order.
+	orientation := float32(1)
+	if signedArea2(clip) < 0 {
+		orientation = -1
+	}
+	output := subject
+	for i := range clip {
+		if len(output) == 0 {
+			break
+		}
+		a, b := clip[i], clip[(i+1)%len(clip)]
+		// Positive if p is on the inside of the edge from a to b.
+		side := func(p point) float32 {
+			return orientation * ((b.x-a.x)*(p.y-a.y) - (b.y-a.y)*(p.x-a.x))
+		}
+		input := output
+		output = make([]point, 0, len(input)+1)
+		for j := range input {
+			current, previous := input[j], input[(j+len(input)-1)%len(input)]
+			currentSide, previousSide := side(current), side(previous)
+			if (currentSide >= 0) != (previousSide >= 0) {
+				// The edge crosses the clip line, so add the crossing point.
+				t := previousSide / (previousSide - currentSide)
+				output = append(output, point{
+					x: previous.x + t*(current.x-previous.x),
+					y: previous.y + t*(current.y-previous.y),
+				})
+			}
+			if currentSide >= 0 {
+				output = append(output, current)
+			}
+		}
+	}
+	return output
+}
+
+// Returns the IoU of two rotated boxes, given their corners.
+func rotatedIoU(a, b []point) float32 {
+	intersection := polygonArea(clipConvexPolygon(a, b))
+	union := polygonArea(a) + polygonArea(b) - intersection
+	if union <= 0 {
+		return 0
+	}
+	return intersection / union
+}
+
+// Draws the outline of each box that has corners set onto dst.
+func drawRotatedBoxes(dst draw.Image, boxes []boundingBox) {
+	offset := dst.Bounds().Min
+	for i := range boxes {
+		corners := boxes[i].corners
+		c := classColor(boxes[i].classID)
+		for j := range corners {
+			a, b := corners[j], corners[(j+1)%len(corners)]
+			drawLine(dst, int(a.x)+offset.X, int(a.y)+offset.Y,
+				int(b.x)+offset.X, int(b.y)+offset.Y, c, boxLineWidth)
+		}
+	}
+}
+
+// Returns a string listing the corners of a rotated box.
+func cornersString(corners []point) string {
+	toReturn := ""
+	for i, p := range corners {
+		if i != 0 {
+			toReturn += ", "
+		}
+		toReturn += fmt.Sprintf("(%f, %f)", p.x, p.y)
+	}
+	return toReturn
+}
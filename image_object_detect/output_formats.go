@@ -0,0 +1,480 @@
+package main
+
+// This file contains the code for reporting detections in formats that can be
+// consumed by other tools, rather than the human-readable text printed by
+// default.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Implemented by each of the supported output formats. WriteDetections is
+// called once per processed image, and Close is called once after all images
+// have been processed. frame is the image's number in its frameSource,
+// starting at 1, which may skip numbers if some frames couldn't be loaded or
+// processed.
+type detectionWriter interface {
+	WriteDetections(frame int, imagePath string, imageWidth, imageHeight int,
+		boxes []boundingBox) error
+	Close() error
+}
+
+// Returns a detectionWriter for the named format. For the "jsonl", "coco",
+// "tracks" and "mot" formats, outputPath is the file to write, or "-" for
+// stdout. For the "yolo" format, outputPath is the directory in which the
+// .txt label files will be created. outputPath is ignored for the "text"
+// format.
+func newDetectionWriter(format, outputPath string) (detectionWriter, error) {
+	switch format {
+	case "text":
+		return &textDetectionWriter{w: os.Stdout}, nil
+	case "jsonl":
+		w, e := openOutputFile(outputPath)
+		if e != nil {
+			return nil, e
+		}
+		return &jsonLinesDetectionWriter{w: w, encoder: json.NewEncoder(w)},
+			nil
+	case "coco":
+		w, e := openOutputFile(outputPath)
+		if e != nil {
+			return nil, e
+		}
+		return &cocoDetectionWriter{
+			w:        w,
+			imageIDs: make(map[string]int),
+			results:  make([]cocoResult, 0, 64),
+		}, nil
+	case "tracks":
+		w, e := openOutputFile(outputPath)
+		if e != nil {
+			return nil, e
+		}
+		return &trackFrameWriter{w: w, encoder: json.NewEncoder(w)}, nil
+	case "mot":
+		w, e := openOutputFile(outputPath)
+		if e != nil {
+			return nil, e
+		}
+		return &motChallengeWriter{w: w}, nil
+	case "yolo":
+		if outputPath == "-" {
+			outputPath = "."
+		}
+		e := os.MkdirAll(outputPath, 0755)
+		if e != nil {
+			return nil, fmt.Errorf("Error creating directory %s: %w",
+				outputPath, e)
+		}
+		return &yoloLabelWriter{dir: outputPath}, nil
+	}
+	return nil, fmt.Errorf("Unknown output format %q", format)
+}
+
+// Reports detections to several detectionWriters. Close closes every
+// writer, returning the first error encountered.
+type multiDetectionWriter []detectionWriter
+
+func (m multiDetectionWriter) WriteDetections(frame int, imagePath string,
+	imageWidth, imageHeight int, boxes []boundingBox) error {
+	for _, w := range m {
+		e := w.WriteDetections(frame, imagePath, imageWidth, imageHeight,
+			boxes)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (m multiDetectionWriter) Close() error {
+	var toReturn error
+	for _, w := range m {
+		e := w.Close()
+		if (e != nil) && (toReturn == nil) {
+			toReturn = e
+		}
+	}
+	return toReturn
+}
+
+// Opens the given path for writing, or returns stdout if the path is "-".
+func openOutputFile(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	f, e := os.Create(path)
+	if e != nil {
+		return nil, fmt.Errorf("Error creating %s: %w", path, e)
+	}
+	return f, nil
+}
+
+// Used so that closing the writer for stdout doesn't close stdout itself.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (n nopWriteCloser) Close() error {
+	return nil
+}
+
+// Prints boxes in the human-readable format this example has always used,
+// preceded by the path to the image they were found in.
+type textDetectionWriter struct {
+	w io.Writer
+}
+
+func (t *textDetectionWriter) WriteDetections(frame int, imagePath string,
+	imageWidth, imageHeight int, boxes []boundingBox) error {
+	_, e := fmt.Fprintf(t.w, "%d objects detected in %s:\n", len(boxes),
+		imagePath)
+	if e != nil {
+		return e
+	}
+	for i, box := range boxes {
+		if box.trackID != 0 {
+			_, e = fmt.Fprintf(t.w, "Box %d (track %d): %s\n", i,
+				box.trackID, &box)
+		} else {
+			_, e = fmt.Fprintf(t.w, "Box %d: %s\n", i, &box)
+		}
+		if e != nil {
+			return e
+		}
+		if box.corners != nil {
+			_, e = fmt.Fprintf(t.w, "  Rotated box corners: %s\n",
+				cornersString(box.corners))
+			if e != nil {
+				return e
+			}
+		}
+		for j, p := range box.keypoints {
+			_, e = fmt.Fprintf(t.w, "  %s: (%f, %f), visibility %f\n",
+				keypointName(j), p.x, p.y, p.visibility)
+			if e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func (t *textDetectionWriter) Close() error {
+	return nil
+}
+
+// A single line of output in the "jsonl" format.
+type jsonDetection struct {
+	ImagePath  string  `json:"image_path"`
+	Label      string  `json:"label"`
+	ClassID    int     `json:"class_id"`
+	Confidence float32 `json:"confidence"`
+	X1         float32 `json:"x1"`
+	Y1         float32 `json:"y1"`
+	X2         float32 `json:"x2"`
+	Y2         float32 `json:"y2"`
+	// Only included when tracking objects across frames.
+	TrackID int `json:"track_id,omitempty"`
+	// Only included for pose networks.
+	Keypoints []jsonKeypoint `json:"keypoints,omitempty"`
+	// Only included for OBB networks. Holds the X and Y coordinates of each
+	// of the rotated box's four corners.
+	Corners [][2]float32 `json:"corners,omitempty"`
+}
+
+type jsonKeypoint struct {
+	Name       string  `json:"name"`
+	X          float32 `json:"x"`
+	Y          float32 `json:"y"`
+	Visibility float32 `json:"visibility"`
+}
+
+// Returns the name of the keypoint with the given index, or a placeholder if
+// the network has more keypoints than we have names for.
+func keypointName(index int) string {
+	if index < len(poseKeypointNames) {
+		return poseKeypointNames[index]
+	}
+	return fmt.Sprintf("keypoint %d", index)
+}
+
+// Writes one JSON object per detected box, one per line.
+type jsonLinesDetectionWriter struct {
+	w       io.WriteCloser
+	encoder *json.Encoder
+}
+
+func (j *jsonLinesDetectionWriter) WriteDetections(frame int, imagePath string,
+	imageWidth, imageHeight int, boxes []boundingBox) error {
+	for _, box := range boxes {
+		d := &jsonDetection{
+			ImagePath:  imagePath,
+			Label:      box.label,
+			ClassID:    box.classID,
+			Confidence: box.confidence,
+			X1:         box.x1,
+			Y1:         box.y1,
+			X2:         box.x2,
+			Y2:         box.y2,
+			TrackID:    box.trackID,
+		}
+		for _, p := range box.corners {
+			d.Corners = append(d.Corners, [2]float32{p.x, p.y})
+		}
+		for k, p := range box.keypoints {
+			d.Keypoints = append(d.Keypoints, jsonKeypoint{
+				Name:       keypointName(k),
+				X:          p.x,
+				Y:          p.y,
+				Visibility: p.visibility,
+			})
+		}
+		e := j.encoder.Encode(d)
+		if e != nil {
+			return fmt.Errorf("Error writing JSON detection: %w", e)
+		}
+	}
+	return nil
+}
+
+func (j *jsonLinesDetectionWriter) Close() error {
+	return j.w.Close()
+}
+
+// A single entry in a COCO "results" file, as read by pycocotools' loadRes.
+type cocoResult struct {
+	ImageID    int        `json:"image_id"`
+	CategoryID int        `json:"category_id"`
+	BBox       [4]float32 `json:"bbox"`
+	Score      float32    `json:"score"`
+}
+
+// Accumulates all detections, and writes them as a single COCO results JSON
+// array when closed.
+type cocoDetectionWriter struct {
+	w        io.WriteCloser
+	imageIDs map[string]int
+	results  []cocoResult
+}
+
+// Returns the COCO image ID for the given path. The COCO dataset's images are
+// named after their IDs (e.g., 000000397133.jpg), so we use the number in the
+// file name if there is one. Otherwise, images are numbered in the order they
+// were processed, starting at 1.
+func (c *cocoDetectionWriter) imageID(imagePath string) int {
+	id, ok := c.imageIDs[imagePath]
+	if ok {
+		return id
+	}
+	base := filepath.Base(imagePath)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	id, e := strconv.Atoi(base)
+	if e != nil {
+		id = len(c.imageIDs) + 1
+	}
+	c.imageIDs[imagePath] = id
+	return id
+}
+
+func (c *cocoDetectionWriter) WriteDetections(frame int, imagePath string,
+	imageWidth, imageHeight int, boxes []boundingBox) error {
+	imageID := c.imageID(imagePath)
+	for _, box := range boxes {
+		// COCO boxes are given as the top-left corner, width and height.
+		c.results = append(c.results, cocoResult{
+			ImageID:    imageID,
+			CategoryID: cocoCategoryID(box.classID),
+			BBox: [4]float32{box.x1, box.y1, box.x2 - box.x1,
+				box.y2 - box.y1},
+			Score: box.confidence,
+		})
+	}
+	return nil
+}
+
+func (c *cocoDetectionWriter) Close() error {
+	data, e := json.MarshalIndent(c.results, "", "  ")
+	if e != nil {
+		c.w.Close()
+		return fmt.Errorf("Error converting COCO results to JSON: %w", e)
+	}
+	_, e = c.w.Write(append(data, '\n'))
+	if e != nil {
+		c.w.Close()
+		return fmt.Errorf("Error writing COCO results: %w", e)
+	}
+	return c.w.Close()
+}
+
+// The COCO dataset's category IDs aren't contiguous; YOLO's 80 class indices
+// map to IDs between 1 and 90. This table is indexed by YOLO class ID.
+var cocoCategoryIDs = []int{
+	1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22,
+	23, 24, 25, 27, 28, 31, 32, 33, 34, 35, 36, 37, 38, 39, 40, 41, 42, 43, 44,
+	46, 47, 48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58, 59, 60, 61, 62, 63, 64,
+	65, 67, 70, 72, 73, 74, 75, 76, 77, 78, 79, 80, 81, 82, 84, 85, 86, 87, 88,
+	89, 90,
+}
+
+// Returns true if the active class labels are the 80 COCO classes used by the
+// stock YOLOv8 networks, either because they're the defaults or because
+// identical labels were loaded from a file or the network's metadata.
+func usingCOCOLabels() bool {
+	if len(classLabels) != len(yoloClasses) {
+		return false
+	}
+	for i, label := range classLabels {
+		if label != yoloClasses[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the COCO category ID for the given class ID. If the active labels
+// are the COCO classes, their IDs are mapped to the dataset's non-contiguous
+// category IDs. Otherwise, such as with -labels, labels from the network's
+// metadata or the DOTA classes used by OBB networks, class IDs are simply
+// offset by one, since COCO category IDs conventionally start at 1. The same
+// applies to class IDs outside of the COCO range.
+func cocoCategoryID(classID int) int {
+	if usingCOCOLabels() && (classID >= 0) &&
+		(classID < len(cocoCategoryIDs)) {
+		return cocoCategoryIDs[classID]
+	}
+	return classID + 1
+}
+
+// Writes one .txt file per image in the format used by YOLO training data:
+// one line per box containing the class ID followed by the box's center X,
+// center Y, width and height, all normalized to the image's size. Rotated
+// boxes are instead written in the YOLO OBB format: the class ID followed by
+// the normalized X and Y coordinates of each of the four corners.
+type yoloLabelWriter struct {
+	dir string
+}
+
+func (y *yoloLabelWriter) WriteDetections(frame int, imagePath string,
+	imageWidth, imageHeight int, boxes []boundingBox) error {
+	labelPath, e := outputFilePath(y.dir, imagePath, ".txt")
+	if e != nil {
+		return e
+	}
+	f, e := os.Create(labelPath)
+	if e != nil {
+		return fmt.Errorf("Error creating %s: %w", labelPath, e)
+	}
+	w, h := float32(imageWidth), float32(imageHeight)
+	for _, box := range boxes {
+		if box.corners != nil {
+			_, e = fmt.Fprintf(f, "%d", box.classID)
+			for _, p := range box.corners {
+				if e == nil {
+					_, e = fmt.Fprintf(f, " %f %f", p.x/w, p.y/h)
+				}
+			}
+			if e == nil {
+				_, e = fmt.Fprintf(f, "\n")
+			}
+			if e != nil {
+				f.Close()
+				return fmt.Errorf("Error writing %s: %w", labelPath, e)
+			}
+			continue
+		}
+		_, e = fmt.Fprintf(f, "%d %f %f %f %f\n", box.classID,
+			(box.x1+box.x2)/2/w, (box.y1+box.y2)/2/h, (box.x2-box.x1)/w,
+			(box.y2-box.y1)/h)
+		if e != nil {
+			f.Close()
+			return fmt.Errorf("Error writing %s: %w", labelPath, e)
+		}
+	}
+	e = f.Close()
+	if e != nil {
+		return fmt.Errorf("Error writing %s: %w", labelPath, e)
+	}
+	return nil
+}
+
+func (y *yoloLabelWriter) Close() error {
+	return nil
+}
+
+// A single line of output in the "tracks" format, holding all of the tracked
+// boxes in one frame.
+type jsonTrackFrame struct {
+	// Frames are numbered starting at 1.
+	Frame     int             `json:"frame"`
+	ImagePath string          `json:"image_path"`
+	Tracks    []jsonDetection `json:"tracks"`
+}
+
+// Writes one JSON object per frame, one per line, listing the boxes
+// belonging to each track in that frame.
+type trackFrameWriter struct {
+	w       io.WriteCloser
+	encoder *json.Encoder
+}
+
+func (t *trackFrameWriter) WriteDetections(frame int, imagePath string,
+	imageWidth, imageHeight int, boxes []boundingBox) error {
+	f := &jsonTrackFrame{
+		Frame:     frame,
+		ImagePath: imagePath,
+		Tracks:    make([]jsonDetection, 0, len(boxes)),
+	}
+	for _, box := range boxes {
+		f.Tracks = append(f.Tracks, jsonDetection{
+			Label:      box.label,
+			ClassID:    box.classID,
+			Confidence: box.confidence,
+			X1:         box.x1,
+			Y1:         box.y1,
+			X2:         box.x2,
+			Y2:         box.y2,
+			TrackID:    box.trackID,
+		})
+	}
+	e := t.encoder.Encode(f)
+	if e != nil {
+		return fmt.Errorf("Error writing JSON tracks: %w", e)
+	}
+	return nil
+}
+
+func (t *trackFrameWriter) Close() error {
+	return t.w.Close()
+}
+
+// Writes tracked boxes in the MOTChallenge text format, with one line per
+// box: the frame number, track ID, the box's left, top, width and height,
+// its confidence, and -1 for the unused 3D coordinates. Frames are numbered
+// starting at 1.
+type motChallengeWriter struct {
+	w io.WriteCloser
+}
+
+func (m *motChallengeWriter) WriteDetections(frame int, imagePath string,
+	imageWidth, imageHeight int, boxes []boundingBox) error {
+	for _, box := range boxes {
+		_, e := fmt.Fprintf(m.w, "%d,%d,%.2f,%.2f,%.2f,%.2f,%.4f,-1,-1,-1\n",
+			frame, box.trackID, box.x1, box.y1, box.x2-box.x1,
+			box.y2-box.y1, box.confidence)
+		if e != nil {
+			return fmt.Errorf("Error writing MOTChallenge tracks: %w", e)
+		}
+	}
+	return nil
+}
+
+func (m *motChallengeWriter) Close() error {
+	return m.w.Close()
+}
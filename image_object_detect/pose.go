@@ -0,0 +1,113 @@
+package main
+
+// This file contains the code for decoding the output of YOLOv8 pose
+// estimation networks, such as yolov8n-pose.onnx, and for drawing the
+// resulting skeletons.
+
+import (
+	"fmt"
+	"image/draw"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// The number of keypoints predicted for each person by YOLOv8 pose networks
+// trained on the COCO keypoints dataset, and the number of values for each
+// keypoint (X, Y, and visibility).
+const (
+	numPoseKeypoints  = 17
+	poseKeypointWidth = 3
+)
+
+// The names of the COCO keypoints, in the order they're output by the network.
+var poseKeypointNames = []string{
+	"nose", "left_eye", "right_eye", "left_ear", "right_ear",
+	"left_shoulder", "right_shoulder", "left_elbow", "right_elbow",
+	"left_wrist", "right_wrist", "left_hip", "right_hip", "left_knee",
+	"right_knee", "left_ankle", "right_ankle",
+}
+
+// Pairs of keypoint indices that are connected by a line when drawing a
+// skeleton.
+var poseSkeleton = [][2]int{
+	{15, 13}, {13, 11}, {16, 14}, {14, 12}, {11, 12}, {5, 11}, {6, 12},
+	{5, 6}, {5, 7}, {6, 8}, {7, 9}, {8, 10}, {1, 2}, {0, 1}, {0, 2}, {1, 3},
+	{2, 4}, {3, 5}, {4, 6},
+}
+
+// Keypoints with a visibility below this aren't drawn.
+const keypointVisibilityThreshold = 0.5
+
+// A single keypoint, in the original image's coordinates.
+type keypoint struct {
+	x, y float32
+	// The network's confidence that the keypoint is visible, between 0 and 1.
+	visibility float32
+}
+
+// Like processOutput, but for pose networks. The output's shape must be 1 x
+// (4 + number of classes + 17*3) x (number of anchors), where the rows after
+// the class probabilities hold the X, Y and visibility of each of the 17 COCO
+// keypoints. Each returned box's keypoints will be set.
+func processPoseOutput(output []float32, outputShape ort.Shape,
+	transform *inputTransform, opts *DetectionOptions) ([]boundingBox, error) {
+	if opts == nil {
+		opts = DefaultDetectionOptions()
+	}
+	numExtra := numPoseKeypoints * poseKeypointWidth
+	if (len(outputShape) != 3) || (outputShape[1] <= int64(4+numExtra)) {
+		return nil, fmt.Errorf("Invalid YOLOv8 pose output shape: %s",
+			outputShape)
+	}
+	candidates, e := decodeYOLOv8Candidates(output, outputShape, numExtra,
+		transform, opts, func(box *boundingBox, _ [4]float32,
+			values []float32) {
+			box.keypoints = make([]keypoint, numPoseKeypoints)
+			for i := range box.keypoints {
+				v := values[i*poseKeypointWidth : (i+1)*poseKeypointWidth]
+				x, y := transform.toOriginal(v[0], v[1])
+				box.keypoints[i] = keypoint{
+					x:          x,
+					y:          y,
+					visibility: v[2],
+				}
+			}
+		})
+	if e != nil {
+		return nil, e
+	}
+	return nonMaxSuppression(candidates, opts), nil
+}
+
+// Draws the skeleton formed by each box's keypoints onto dst, skipping any
+// keypoints that aren't likely to be visible. Does nothing for boxes without
+// keypoints.
+func drawSkeletons(dst draw.Image, boxes []boundingBox) {
+	offset := dst.Bounds().Min
+	for i := range boxes {
+		points := boxes[i].keypoints
+		if len(points) == 0 {
+			continue
+		}
+		c := classColor(boxes[i].classID)
+		for j, limb := range poseSkeleton {
+			if (limb[0] >= len(points)) || (limb[1] >= len(points)) {
+				continue
+			}
+			a, b := points[limb[0]], points[limb[1]]
+			if (a.visibility < keypointVisibilityThreshold) ||
+				(b.visibility < keypointVisibilityThreshold) {
+				continue
+			}
+			drawLine(dst, int(a.x)+offset.X, int(a.y)+offset.Y,
+				int(b.x)+offset.X, int(b.y)+offset.Y,
+				boxPalette[j%len(boxPalette)], 2)
+		}
+		for _, p := range points {
+			if p.visibility < keypointVisibilityThreshold {
+				continue
+			}
+			drawDot(dst, int(p.x)+offset.X, int(p.y)+offset.Y, 4, c)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+// This file contains the code for converting images into the network's input
+// format.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/nfnt/resize"
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// The gray value YOLO networks are trained to expect in the padding added
+// around letterboxed images.
+const letterboxPadValue = 114.0 / 255.0
+
+// Records how an original image was mapped onto the network's input, so that
+// boxes in the network's output can be mapped back onto the original image.
+// A point (x, y) in the original image ends up at (x*scaleX + padX,
+// y*scaleY + padY) in the network's input.
+type inputTransform struct {
+	scaleX, scaleY float32
+	padX, padY     float32
+	// The size of the original image, used to clip boxes to its bounds.
+	originalWidth, originalHeight int
+	// The size of the network's input image.
+	inputWidth, inputHeight int
+}
+
+// Maps a point in the network's input back to the original image, clipping
+// it to the original image's bounds.
+func (t *inputTransform) toOriginal(x, y float32) (float32, float32) {
+	x, y = t.toOriginalUnclipped(x, y)
+	return clampFloat(x, 0, float32(t.originalWidth)),
+		clampFloat(y, 0, float32(t.originalHeight))
+}
+
+// Like toOriginal, but the returned point may lie outside of the original
+// image.
+func (t *inputTransform) toOriginalUnclipped(x, y float32) (float32,
+	float32) {
+	return (x - t.padX) / t.scaleX, (y - t.padY) / t.scaleY
+}
+
+// Maps a point in the original image to the network's input. This is the
+// inverse of toOriginal, apart from clipping.
+func (t *inputTransform) toInput(x, y float32) (float32, float32) {
+	return x*t.scaleX + t.padX, y*t.scaleY + t.padY
+}
+
+func clampFloat(v, min, max float32) float32 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// Populates the given batch index of a yolov8n input tensor with the contents
+// of the given image. The tensor must have shape N x 3 x height x width. If
+// letterbox is true, the image will be scaled to fit the network's input while
+// preserving its aspect ratio, with the remaining space filled with gray.
+// Otherwise it's stretched to fill the entire input. Returns the transform
+// needed to map boxes back to the original image.
+func prepareInput(pic image.Image, dst *ort.Tensor[float32], batchIndex int,
+	letterbox bool) (*inputTransform, error) {
+	shape := dst.GetShape()
+	if (len(shape) != 4) || (shape[1] != 3) {
+		return nil, fmt.Errorf("Expected a Nx3xHxW input tensor, got %s",
+			shape)
+	}
+	if (batchIndex < 0) || (int64(batchIndex) >= shape[0]) {
+		return nil, fmt.Errorf("Batch index %d is out of range for input "+
+			"shape %s", batchIndex, shape)
+	}
+	inputHeight, inputWidth := int(shape[2]), int(shape[3])
+	channelSize := inputWidth * inputHeight
+	data := dst.GetData()
+	if len(data) < (channelSize * 3 * int(shape[0])) {
+		return nil, fmt.Errorf("Destination tensor only holds %d floats, "+
+			"needs %d (make sure it's the right shape!)", len(data),
+			channelSize*3*int(shape[0]))
+	}
+	data = data[channelSize*3*batchIndex : channelSize*3*(batchIndex+1)]
+	return fillInputData(pic, data, inputWidth, inputHeight, letterbox), nil
+}
+
+// Does the work of prepareInput, writing the image into a slice holding the
+// three planes of a single input image with the given dimensions.
+func fillInputData(pic image.Image, data []float32, inputWidth,
+	inputHeight int, letterbox bool) *inputTransform {
+	channelSize := inputWidth * inputHeight
+	redChannel := data[0:channelSize]
+	greenChannel := data[channelSize : channelSize*2]
+	blueChannel := data[channelSize*2 : channelSize*3]
+
+	bounds := pic.Bounds().Canon()
+	transform := &inputTransform{
+		originalWidth:  bounds.Dx(),
+		originalHeight: bounds.Dy(),
+		inputWidth:     inputWidth,
+		inputHeight:    inputHeight,
+	}
+	scaledWidth, scaledHeight := inputWidth, inputHeight
+	if letterbox {
+		scale := float32(inputWidth) / float32(bounds.Dx())
+		if s := float32(inputHeight) / float32(bounds.Dy()); s < scale {
+			scale = s
+		}
+		scaledWidth = int(float32(bounds.Dx())*scale + 0.5)
+		scaledHeight = int(float32(bounds.Dy())*scale + 0.5)
+		transform.padX = float32((inputWidth - scaledWidth) / 2)
+		transform.padY = float32((inputHeight - scaledHeight) / 2)
+		for i := range data {
+			data[i] = letterboxPadValue
+		}
+	}
+	transform.scaleX = float32(scaledWidth) / float32(bounds.Dx())
+	transform.scaleY = float32(scaledHeight) / float32(bounds.Dy())
+
+	// Resize the image using Lanczos3 algorithm
+	pic = resize.Resize(uint(scaledWidth), uint(scaledHeight), pic,
+		resize.Lanczos3)
+	copyToPlanes(pic, &chwPlanes{
+		red:     redChannel,
+		green:   greenChannel,
+		blue:    blueChannel,
+		width:   inputWidth,
+		offsetX: int(transform.padX),
+		offsetY: int(transform.padY),
+	})
+	return transform
+}
+
+// The destination of a copy from an image into the network's planar input
+// layout, where each color channel is stored separately in row-major order.
+type chwPlanes struct {
+	red, green, blue []float32
+	// The width of a row in each plane.
+	width int
+	// The position in each plane at which the top-left pixel of the image
+	// is written.
+	offsetX, offsetY int
+}
+
+// Returns the index in each plane to which the leftmost pixel of the given
+// image row (counting from 0) is written.
+func (p *chwPlanes) rowStart(y int) int {
+	return (y+p.offsetY)*p.width + p.offsetX
+}
+
+// Copies the pixels of pic into the planes, scaling each channel to a float
+// between 0 and 1. Uses a fast path for the image types returned by the resize
+// library, which avoids calling the image.Image interface's At() function for
+// every pixel. Rows are split among several goroutines.
+func copyToPlanes(pic image.Image, dst *chwPlanes) {
+	var copyRows func(startY, endY int)
+	switch p := pic.(type) {
+	case *image.RGBA:
+		copyRows = func(startY, endY int) {
+			copyRGBARows(p, dst, startY, endY)
+		}
+	case *image.NRGBA:
+		copyRows = func(startY, endY int) {
+			copyNRGBARows(p, dst, startY, endY)
+		}
+	case *image.YCbCr:
+		copyRows = func(startY, endY int) {
+			copyYCbCrRows(p, dst, startY, endY)
+		}
+	case *image.Gray:
+		copyRows = func(startY, endY int) {
+			copyGrayRows(p, dst, startY, endY)
+		}
+	default:
+		copyRows = func(startY, endY int) {
+			copyGenericRows(pic, dst, startY, endY)
+		}
+	}
+	parallelizeRows(pic.Bounds().Dy(), copyRows)
+}
+
+// Calls f with non-overlapping ranges of rows covering [0, rows), in parallel
+// using up to one goroutine per CPU. Returns after all calls have completed.
+func parallelizeRows(rows int, f func(startY, endY int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > rows {
+		workers = rows
+	}
+	if workers <= 1 {
+		f(0, rows)
+		return
+	}
+	var wg sync.WaitGroup
+	rowsPerWorker := (rows + workers - 1) / workers
+	for startY := 0; startY < rows; startY += rowsPerWorker {
+		endY := min(startY+rowsPerWorker, rows)
+		wg.Add(1)
+		go func(startY, endY int) {
+			defer wg.Done()
+			f(startY, endY)
+		}(startY, endY)
+	}
+	wg.Wait()
+}
+
+// The original per-pixel implementation, which works with any image type.
+func copyGenericRows(pic image.Image, dst *chwPlanes, startY, endY int) {
+	bounds := pic.Bounds()
+	for y := startY; y < endY; y++ {
+		i := dst.rowStart(y)
+		for x := 0; x < bounds.Dx(); x++ {
+			r, g, b, _ := pic.At(x+bounds.Min.X, y+bounds.Min.Y).RGBA()
+			dst.red[i] = float32(r>>8) / 255.0
+			dst.green[i] = float32(g>>8) / 255.0
+			dst.blue[i] = float32(b>>8) / 255.0
+			i++
+		}
+	}
+}
+
+func copyRGBARows(pic *image.RGBA, dst *chwPlanes, startY, endY int) {
+	bounds := pic.Bounds()
+	for y := startY; y < endY; y++ {
+		rowOffset := pic.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+		src := pic.Pix[rowOffset : rowOffset+bounds.Dx()*4]
+		i := dst.rowStart(y)
+		for x := 0; x < len(src); x += 4 {
+			dst.red[i] = float32(src[x]) / 255.0
+			dst.green[i] = float32(src[x+1]) / 255.0
+			dst.blue[i] = float32(src[x+2]) / 255.0
+			i++
+		}
+	}
+}
+
+// Like copyRGBARows, but premultiplies by alpha in the same way as
+// color.NRGBA's RGBA() function, so the result matches copyGenericRows.
+func copyNRGBARows(pic *image.NRGBA, dst *chwPlanes, startY, endY int) {
+	bounds := pic.Bounds()
+	for y := startY; y < endY; y++ {
+		rowOffset := pic.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+		src := pic.Pix[rowOffset : rowOffset+bounds.Dx()*4]
+		i := dst.rowStart(y)
+		for x := 0; x < len(src); x += 4 {
+			a := uint32(src[x+3]) * 0x101
+			r := uint32(src[x]) * 0x101 * a / 0xffff
+			g := uint32(src[x+1]) * 0x101 * a / 0xffff
+			b := uint32(src[x+2]) * 0x101 * a / 0xffff
+			dst.red[i] = float32(r>>8) / 255.0
+			dst.green[i] = float32(g>>8) / 255.0
+			dst.blue[i] = float32(b>>8) / 255.0
+			i++
+		}
+	}
+}
+
+// Copies a grayscale image, such as the ones produced when resizing a
+// grayscale PNG, by writing the same value to all three planes.
+func copyGrayRows(pic *image.Gray, dst *chwPlanes, startY, endY int) {
+	bounds := pic.Bounds()
+	for y := startY; y < endY; y++ {
+		rowOffset := pic.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+		src := pic.Pix[rowOffset : rowOffset+bounds.Dx()]
+		i := dst.rowStart(y)
+		for _, v := range src {
+			value := float32(v) / 255.0
+			dst.red[i] = value
+			dst.green[i] = value
+			dst.blue[i] = value
+			i++
+		}
+	}
+}
+
+func copyYCbCrRows(pic *image.YCbCr, dst *chwPlanes, startY, endY int) {
+	bounds := pic.Bounds()
+	for y := startY; y < endY; y++ {
+		i := dst.rowStart(y)
+		for x := 0; x < bounds.Dx(); x++ {
+			// YOffset and COffset account for chroma subsampling. Calling
+			// RGBA() on the concrete color.YCbCr type keeps the results
+			// identical to copyGenericRows.
+			yi := pic.YOffset(x+bounds.Min.X, y+bounds.Min.Y)
+			ci := pic.COffset(x+bounds.Min.X, y+bounds.Min.Y)
+			r, g, b, _ := color.YCbCr{
+				Y:  pic.Y[yi],
+				Cb: pic.Cb[ci],
+				Cr: pic.Cr[ci],
+			}.RGBA()
+			dst.red[i] = float32(r>>8) / 255.0
+			dst.green[i] = float32(g>>8) / 255.0
+			dst.blue[i] = float32(b>>8) / 255.0
+			i++
+		}
+	}
+}
+
+// Compares the time taken to copy a resized image into the network's input
+// using copyToPlanes against the original per-pixel implementation, running
+// each one the given number of times. Prints the results to stdout. This
+// doesn't require onnxruntime.
+func benchmarkPreprocessing(pic image.Image, iterations int) {
+	const inputSize = 640
+	resized := resize.Resize(inputSize, inputSize, pic, resize.Lanczos3)
+	newPlanes := func() *chwPlanes {
+		data := make([]float32, inputSize*inputSize*3)
+		return &chwPlanes{
+			red:   data[0 : inputSize*inputSize],
+			green: data[inputSize*inputSize : 2*inputSize*inputSize],
+			blue:  data[2*inputSize*inputSize:],
+			width: inputSize,
+		}
+	}
+	genericPlanes := newPlanes()
+	fastPlanes := newPlanes()
+
+	start := time.Now()
+	for i := 0; i < iterations; i++ {
+		copyGenericRows(resized, genericPlanes, 0, inputSize)
+	}
+	genericTime := time.Since(start) / time.Duration(iterations)
+	start = time.Now()
+	for i := 0; i < iterations; i++ {
+		copyToPlanes(resized, fastPlanes)
+	}
+	fastTime := time.Since(start) / time.Duration(iterations)
+	start = time.Now()
+	data := make([]float32, inputSize*inputSize*3)
+	for i := 0; i < iterations; i++ {
+		fillInputData(pic, data, inputSize, inputSize, true)
+	}
+	totalTime := time.Since(start) / time.Duration(iterations)
+
+	// Make sure the fast path didn't change the results.
+	var maxDifference float32
+	for i, v := range genericPlanes.red {
+		maxDifference = max(maxDifference, abs32(v-fastPlanes.red[i]),
+			abs32(genericPlanes.green[i]-fastPlanes.green[i]),
+			abs32(genericPlanes.blue[i]-fastPlanes.blue[i]))
+	}
+
+	fmt.Printf("Copying a %T into the input tensor, averaged over %d "+
+		"iterations:\n", resized, iterations)
+	fmt.Printf("  Original per-pixel At() loop: %s\n", genericTime)
+	fmt.Printf("  Fast path using %d goroutines: %s (%.1fx faster)\n",
+		runtime.GOMAXPROCS(0), fastTime,
+		float64(genericTime)/float64(fastTime))
+	fmt.Printf("  Max difference between the two outputs: %f\n",
+		maxDifference)
+	fmt.Printf("Complete preprocessing, including resizing: %s\n", totalTime)
+}
+
+func abs32(v float32) float32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// Hides the concrete type of an image, so copyToPlanes uses the generic path.
+type opaqueImage struct {
+	image.Image
+}
+
+// Returns planes large enough to hold an image of the given size, with some
+// padding around it to check that the offsets are respected.
+func newTestPlanes(width, height int) *chwPlanes {
+	planeWidth, planeHeight := width+7, height+5
+	size := planeWidth * planeHeight
+	data := make([]float32, size*3)
+	return &chwPlanes{
+		red:     data[0:size],
+		green:   data[size : size*2],
+		blue:    data[size*2:],
+		width:   planeWidth,
+		offsetX: 3,
+		offsetY: 2,
+	}
+}
+
+// Returns random test images of each type with a fast path. The images'
+// bounds don't start at (0, 0), to make sure that's handled.
+func newTestImages(width, height int) map[string]image.Image {
+	rng := rand.New(rand.NewSource(1337))
+	r := image.Rect(5, 9, 5+width, 9+height)
+	rgba := image.NewRGBA(r)
+	nrgba := image.NewNRGBA(r)
+	gray := image.NewGray(r)
+	rng.Read(rgba.Pix)
+	rng.Read(nrgba.Pix)
+	rng.Read(gray.Pix)
+	// Make sure the RGBA image is valid, i.e., alpha-premultiplied.
+	for i := 0; i < len(rgba.Pix); i += 4 {
+		a := rgba.Pix[i+3]
+		rgba.Pix[i] = min(rgba.Pix[i], a)
+		rgba.Pix[i+1] = min(rgba.Pix[i+1], a)
+		rgba.Pix[i+2] = min(rgba.Pix[i+2], a)
+	}
+	toReturn := map[string]image.Image{
+		"RGBA":  rgba,
+		"NRGBA": nrgba,
+		"Gray":  gray,
+	}
+	ratios := map[string]image.YCbCrSubsampleRatio{
+		"YCbCr444": image.YCbCrSubsampleRatio444,
+		"YCbCr422": image.YCbCrSubsampleRatio422,
+		"YCbCr420": image.YCbCrSubsampleRatio420,
+	}
+	for name, ratio := range ratios {
+		ycbcr := image.NewYCbCr(r, ratio)
+		rng.Read(ycbcr.Y)
+		rng.Read(ycbcr.Cb)
+		rng.Read(ycbcr.Cr)
+		toReturn[name] = ycbcr
+	}
+	// Sub-images share their parent's pixels but have a different stride.
+	sub := image.Rect(8, 10, 5+width-2, 9+height-1)
+	toReturn["RGBA sub-image"] = rgba.SubImage(sub)
+	toReturn["YCbCr sub-image"] = toReturn["YCbCr420"].(*image.YCbCr).
+		SubImage(sub)
+	return toReturn
+}
+
+func TestCopyToPlanesMatchesGeneric(t *testing.T) {
+	for name, pic := range newTestImages(67, 43) {
+		bounds := pic.Bounds()
+		expected := newTestPlanes(bounds.Dx(), bounds.Dy())
+		copyGenericRows(pic, expected, 0, bounds.Dy())
+		actual := newTestPlanes(bounds.Dx(), bounds.Dy())
+		copyToPlanes(pic, actual)
+		planes := [][2][]float32{
+			{expected.red, actual.red},
+			{expected.green, actual.green},
+			{expected.blue, actual.blue},
+		}
+		for c, p := range planes {
+			for i := range p[0] {
+				if p[0][i] != p[1][i] {
+					t.Fatalf("%s: channel %d differs from the generic path "+
+						"at index %d: expected %f, got %f", name, c, i,
+						p[0][i], p[1][i])
+				}
+			}
+		}
+	}
+}
+
+func TestCopyGrayRows(t *testing.T) {
+	pic := image.NewGray(image.Rect(0, 0, 2, 1))
+	pic.SetGray(0, 0, color.Gray{Y: 0})
+	pic.SetGray(1, 0, color.Gray{Y: 255})
+	dst := newTestPlanes(2, 1)
+	copyToPlanes(pic, dst)
+	i := dst.rowStart(0)
+	if (dst.red[i] != 0) || (dst.green[i+1] != 1) || (dst.blue[i+1] != 1) {
+		t.Fatalf("Got incorrect gray values: %v, %v, %v", dst.red[i:i+2],
+			dst.green[i:i+2], dst.blue[i:i+2])
+	}
+}
+
+func benchmarkCopy(b *testing.B, pic image.Image) {
+	bounds := pic.Bounds()
+	dst := newTestPlanes(bounds.Dx(), bounds.Dy())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copyToPlanes(pic, dst)
+	}
+}
+
+func BenchmarkCopyToPlanesRGBA(b *testing.B) {
+	benchmarkCopy(b, newTestImages(640, 640)["RGBA"])
+}
+
+func BenchmarkCopyToPlanesNRGBA(b *testing.B) {
+	benchmarkCopy(b, newTestImages(640, 640)["NRGBA"])
+}
+
+func BenchmarkCopyToPlanesYCbCr(b *testing.B) {
+	benchmarkCopy(b, newTestImages(640, 640)["YCbCr420"])
+}
+
+func BenchmarkCopyToPlanesGray(b *testing.B) {
+	benchmarkCopy(b, newTestImages(640, 640)["Gray"])
+}
+
+// Uses the original per-pixel implementation, for comparison with the fast
+// paths.
+func BenchmarkCopyToPlanesGeneric(b *testing.B) {
+	benchmarkCopy(b, opaqueImage{newTestImages(640, 640)["RGBA"]})
+}
@@ -0,0 +1,233 @@
+package main
+
+// This file contains the code for redacting detected objects, such as people
+// or license plates, by blurring or pixelating them, so that images can be
+// shared without identifying anyone.
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"os"
+)
+
+// Selects how redacted regions are obscured.
+type redactionMethod int
+
+const (
+	// Applies a Gaussian blur to each region.
+	redactBlur redactionMethod = iota
+	// Replaces each region with large blocks of its average colors.
+	redactPixelate
+)
+
+func (m redactionMethod) String() string {
+	switch m {
+	case redactBlur:
+		return "blur"
+	case redactPixelate:
+		return "pixelate"
+	}
+	return fmt.Sprintf("unknown redaction method %d", int(m))
+}
+
+// Converts the name of a redaction method, as returned by
+// redactionMethod.String(), to the redactionMethod.
+func parseRedactionMethod(name string) (redactionMethod, error) {
+	for _, m := range []redactionMethod{redactBlur, redactPixelate} {
+		if name == m.String() {
+			return m, nil
+		}
+	}
+	return redactBlur, fmt.Errorf("Unknown redaction method %q", name)
+}
+
+// Obscures the regions of an image covered by boxes of chosen classes.
+type redactor struct {
+	// If non-nil, only boxes with class IDs in this set are redacted.
+	classes map[int]bool
+	method  redactionMethod
+	// The blur's standard deviation, or the size of each pixelated block, in
+	// pixels. If zero or negative, it's chosen based on each box's size.
+	strength int
+	// Boxes less confident than this aren't redacted. This is the -confidence
+	// setting, since the detector's threshold is lowered when tracking.
+	minConfidence float32
+}
+
+// Returns a copy of pic in which the region covered by each box with one of
+// the redactor's classes (and at least its minimum confidence) is obscured.
+// If a box has a segmentation mask, only the pixels within the mask are
+// obscured.
+func (r *redactor) redact(pic image.Image, boxes []boundingBox) *image.RGBA {
+	bounds := pic.Bounds()
+	toReturn := image.NewRGBA(bounds)
+	draw.Draw(toReturn, bounds, pic, bounds.Min, draw.Src)
+	// Obscure the regions using the original image, so that overlapping
+	// boxes don't blur already-blurred pixels.
+	original := image.NewRGBA(bounds)
+	copy(original.Pix, toReturn.Pix)
+	for i := range boxes {
+		box := &(boxes[i])
+		if (r.classes != nil) && !r.classes[box.classID] {
+			continue
+		}
+		if box.confidence < r.minConfidence {
+			continue
+		}
+		rect := box.toRect().Add(bounds.Min).Intersect(bounds)
+		if rect.Empty() {
+			continue
+		}
+		strength := r.strength
+		if strength <= 0 {
+			// Scale the effect with the box's size, so that large objects
+			// are obscured as well as small ones.
+			strength = max(rect.Dx(), rect.Dy())/10 + 2
+		}
+		// Returns true if the pixel at (x, y) should be obscured.
+		inMask := func(x, y int) bool {
+			if box.mask == nil {
+				return true
+			}
+			return box.mask.AlphaAt(x-bounds.Min.X, y-bounds.Min.Y).A != 0
+		}
+		if r.method == redactPixelate {
+			pixelateRegion(toReturn, original, rect, strength, inMask)
+		} else {
+			blurRegion(toReturn, original, rect, float64(strength), inMask)
+		}
+	}
+	return toReturn
+}
+
+// Replaces each square block of blockSize pixels within r with its average
+// color. Only pixels for which inMask returns true are modified.
+func pixelateRegion(dst, src *image.RGBA, r image.Rectangle, blockSize int,
+	inMask func(x, y int) bool) {
+	for blockY := r.Min.Y; blockY < r.Max.Y; blockY += blockSize {
+		for blockX := r.Min.X; blockX < r.Max.X; blockX += blockSize {
+			block := image.Rect(blockX, blockY, blockX+blockSize,
+				blockY+blockSize).Intersect(r)
+			var sum [4]int
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				for x := block.Min.X; x < block.Max.X; x++ {
+					p := src.Pix[src.PixOffset(x, y):]
+					for c := range sum {
+						sum[c] += int(p[c])
+					}
+				}
+			}
+			count := block.Dx() * block.Dy()
+			for y := block.Min.Y; y < block.Max.Y; y++ {
+				for x := block.Min.X; x < block.Max.X; x++ {
+					if !inMask(x, y) {
+						continue
+					}
+					p := dst.Pix[dst.PixOffset(x, y):]
+					for c := range sum {
+						p[c] = uint8(sum[c] / count)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Applies a Gaussian blur with the given standard deviation to the pixels
+// within r. Pixels outside of r (but within the image) contribute to the
+// blurred pixels near r's edges. Only pixels for which inMask returns true
+// are modified.
+func blurRegion(dst, src *image.RGBA, r image.Rectangle, sigma float64,
+	inMask func(x, y int) bool) {
+	radius := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, 2*radius+1)
+	sum := 0.0
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-(d * d) / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	// The blur is separable, so first blur the rows horizontally, including
+	// the rows within radius of r that are needed by the vertical pass.
+	bounds := src.Bounds()
+	rows := image.Rect(r.Min.X, r.Min.Y-radius, r.Max.X,
+		r.Max.Y+radius).Intersect(bounds)
+	width := rows.Dx()
+	horizontal := make([][4]float64, width*rows.Dy())
+	for y := rows.Min.Y; y < rows.Max.Y; y++ {
+		row := horizontal[(y-rows.Min.Y)*width:]
+		for x := rows.Min.X; x < rows.Max.X; x++ {
+			var v [4]float64
+			for k, weight := range kernel {
+				sx := min(max(x+k-radius, bounds.Min.X), bounds.Max.X-1)
+				p := src.Pix[src.PixOffset(sx, y):]
+				for c := range v {
+					v[c] += weight * float64(p[c])
+				}
+			}
+			row[x-rows.Min.X] = v
+		}
+	}
+
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if !inMask(x, y) {
+				continue
+			}
+			var v [4]float64
+			for k, weight := range kernel {
+				sy := min(max(y+k-radius, rows.Min.Y), rows.Max.Y-1)
+				h := horizontal[(sy-rows.Min.Y)*width+(x-rows.Min.X)]
+				for c := range v {
+					v[c] += weight * h[c]
+				}
+			}
+			p := dst.Pix[dst.PixOffset(x, y):]
+			for c := range v {
+				p[c] = uint8(min(max(math.Round(v[c]), 0), 255))
+			}
+		}
+	}
+}
+
+// Saves a redacted copy of each image to a directory.
+type redactedImageWriter struct {
+	dir string
+	r   *redactor
+}
+
+// Returns a redactedImageWriter saving images to dir, creating dir if it
+// doesn't exist.
+func newRedactedImageWriter(dir string,
+	r *redactor) (*redactedImageWriter, error) {
+	e := os.MkdirAll(dir, 0755)
+	if e != nil {
+		return nil, fmt.Errorf("Error creating %s: %w", dir, e)
+	}
+	return &redactedImageWriter{dir: dir, r: r}, nil
+}
+
+// Redacted images must hide every object detected in each frame, including
+// objects whose tracks haven't been confirmed yet, or which the tracker has
+// briefly lost.
+func (w *redactedImageWriter) usesUntrackedBoxes() bool {
+	return true
+}
+
+func (w *redactedImageWriter) WriteImage(frame int, imagePath string,
+	pic image.Image, boxes []boundingBox) error {
+	path, e := imageOutputPath(w.dir, imagePath)
+	if e == nil {
+		e = saveImage(w.r.redact(pic, boxes), path)
+	}
+	if e != nil {
+		return fmt.Errorf("Error saving redacted image: %w", e)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+// This file contains the code for decoding the output of YOLOv8 instance
+// segmentation networks, such as yolov8n-seg.onnx.
+
+import (
+	"fmt"
+	"image"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// Like processOutput, but for segmentation networks. The output's shape must
+// be 1 x (4 + number of classes + number of masks) x (number of anchors), where
+// the rows after the class probabilities hold each anchor's mask
+// coefficients. The protos must have shape 1 x (number of masks) x (mask
+// height) x (mask width). Each returned box's mask will be set.
+func processSegmentationOutput(output []float32, outputShape ort.Shape,
+	protos []float32, protoShape ort.Shape, transform *inputTransform,
+	opts *DetectionOptions) ([]boundingBox, error) {
+	if opts == nil {
+		opts = DefaultDetectionOptions()
+	}
+	if len(protoShape) != 4 {
+		return nil, fmt.Errorf("Invalid prototype mask shape: %s", protoShape)
+	}
+	if int64(len(protos)) < protoShape.FlattenedSize() {
+		return nil, fmt.Errorf("Prototype masks only contain %d floats, "+
+			"expected %d for shape %s", len(protos),
+			protoShape.FlattenedSize(), protoShape)
+	}
+	numMasks := int(protoShape[1])
+	candidates, e := decodeYOLOv8Candidates(output, outputShape, numMasks,
+		transform, opts, func(box *boundingBox, _ [4]float32,
+			values []float32) {
+			box.maskCoefficients = values
+		})
+	if e != nil {
+		return nil, e
+	}
+
+	// Only compute masks for the boxes that survive NMS, since computing
+	// masks is relatively expensive.
+	boxes := nonMaxSuppression(candidates, opts)
+	for i := range boxes {
+		boxes[i].mask = computeMask(&(boxes[i]), protos, protoShape, transform)
+	}
+	return boxes, nil
+}
+
+// Returns the binary mask for the given box, covering the part of the box
+// that lies within the original image. The mask is a linear combination of
+// the prototype masks using the box's mask coefficients, passed through a
+// sigmoid and thresholded at 0.5. The prototype masks are lower-resolution
+// than the network's input, so they're bilinearly interpolated.
+func computeMask(box *boundingBox, protos []float32, protoShape ort.Shape,
+	transform *inputTransform) *image.Alpha {
+	bounds := box.toRect().Intersect(image.Rect(0, 0,
+		transform.originalWidth, transform.originalHeight))
+	mask := image.NewAlpha(bounds)
+	if bounds.Empty() {
+		return mask
+	}
+	numMasks := int(protoShape[1])
+	protoHeight, protoWidth := int(protoShape[2]), int(protoShape[3])
+	protoSize := protoWidth * protoHeight
+	scaleX := float32(protoWidth) / float32(transform.inputWidth)
+	scaleY := float32(protoHeight) / float32(transform.inputHeight)
+
+	// Converts a point in the original image to prototype mask coordinates,
+	// where the center of the top-left prototype pixel is at (0, 0).
+	toProto := func(x, y float32) (float32, float32) {
+		x, y = transform.toInput(x, y)
+		return x*scaleX - 0.5, y*scaleY - 0.5
+	}
+
+	// Determine the region of the prototype masks covered by the box,
+	// including a pixel of margin for interpolation, and compute the
+	// combined mask's logits within it.
+	minX, minY := toProto(float32(bounds.Min.X), float32(bounds.Min.Y))
+	maxX, maxY := toProto(float32(bounds.Max.X), float32(bounds.Max.Y))
+	region := image.Rect(int(minX)-1, int(minY)-1, int(maxX)+2, int(maxY)+2)
+	region = region.Intersect(image.Rect(0, 0, protoWidth, protoHeight))
+	if region.Empty() {
+		return mask
+	}
+	logits := make([]float32, region.Dx()*region.Dy())
+	for k := 0; k < numMasks; k++ {
+		coefficient := box.maskCoefficients[k]
+		proto := protos[k*protoSize : (k+1)*protoSize]
+		i := 0
+		for y := region.Min.Y; y < region.Max.Y; y++ {
+			row := proto[y*protoWidth : (y+1)*protoWidth]
+			for x := region.Min.X; x < region.Max.X; x++ {
+				logits[i] += coefficient * row[x]
+				i++
+			}
+		}
+	}
+	logitAt := func(x, y int) float32 {
+		x = min(max(x, region.Min.X), region.Max.X-1)
+		y = min(max(y, region.Min.Y), region.Max.Y-1)
+		return logits[(y-region.Min.Y)*region.Dx()+(x-region.Min.X)]
+	}
+
+	// sigmoid(v) > 0.5 is equivalent to v > 0, so we can skip computing the
+	// sigmoid entirely.
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			px, py := toProto(float32(x)+0.5, float32(y)+0.5)
+			x0, y0 := int(floor32(px)), int(floor32(py))
+			fx, fy := px-float32(x0), py-float32(y0)
+			top := logitAt(x0, y0)*(1-fx) + logitAt(x0+1, y0)*fx
+			bottom := logitAt(x0, y0+1)*(1-fx) + logitAt(x0+1, y0+1)*fx
+			if top*(1-fy)+bottom*fy > 0 {
+				mask.Pix[mask.PixOffset(x, y)] = 0xff
+			}
+		}
+	}
+	return mask
+}
+
+func floor32(v float32) float32 {
+	f := float32(int(v))
+	if f > v {
+		f--
+	}
+	return f
+}
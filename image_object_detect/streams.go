@@ -0,0 +1,493 @@
+package main
+
+// This file contains the code for reading frames from sources other than
+// individual image files, namely animated GIFs and MJPEG streams, and for
+// writing an annotated animated GIF.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nfnt/resize"
+	"github.com/yalue/onnxruntime_go_examples/common/imageutil"
+)
+
+// Produces the images to process, in order.
+type frameSource interface {
+	// Returns the next image along with a name identifying it in the output.
+	// Returns io.EOF after the last image. Any other error only applies to
+	// the image with the returned name, and the next call will move on to
+	// the following image, unless the error means that no more images can be
+	// read (e.g., a stream's connection was lost), in which case the next
+	// call returns io.EOF.
+	NextFrame() (string, image.Image, error)
+	// Returns the number of the image most recently returned by NextFrame,
+	// starting at 1. Images that fail to load are counted, too.
+	FrameNumber() int
+	Close() error
+}
+
+// A frameSource loading each of a list of image files.
+type fileFrameSource struct {
+	paths []string
+	next  int
+}
+
+func newFileFrameSource(paths []string) *fileFrameSource {
+	return &fileFrameSource{paths: paths}
+}
+
+func (s *fileFrameSource) NextFrame() (string, image.Image, error) {
+	if s.next >= len(s.paths) {
+		return "", nil, io.EOF
+	}
+	path := s.paths[s.next]
+	s.next++
+	pic, e := loadImageFile(path)
+	return path, pic, e
+}
+
+func (s *fileFrameSource) FrameNumber() int {
+	return s.next
+}
+
+func (s *fileFrameSource) Close() error {
+	return nil
+}
+
+// Returns the name of a frame from a GIF or stream. The names look like
+// image file names without an extension, so that outputs named after the
+// input images, such as annotated images or YOLO label files, get a separate
+// file per frame.
+func frameName(sourceName string, frame int) string {
+	return fmt.Sprintf("%s_%06d", sourceName, frame)
+}
+
+// Returns the name of a source file or URL without its directory or
+// extension, for use in frame names.
+func sourceBaseName(source string) string {
+	base := filepath.Base(source)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	if (base == "") || (base == ".") || (base == "/") {
+		return "frame"
+	}
+	return base
+}
+
+// A frameSource producing each frame of an animated GIF. GIF frames may only
+// update part of the image, so each frame is composited onto the previous
+// ones, following each frame's disposal method, to produce the full image
+// that would be displayed.
+type gifFrameSource struct {
+	name   string
+	anim   *gif.GIF
+	canvas *image.RGBA
+	// The canvas before drawing the previous frame, used for the "restore to
+	// previous" disposal method.
+	saved *image.RGBA
+	next  int
+}
+
+func newGIFFrameSource(path string) (*gifFrameSource, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, fmt.Errorf("Error opening %s: %w", path, e)
+	}
+	defer f.Close()
+	anim, e := gif.DecodeAll(f)
+	if e != nil {
+		return nil, fmt.Errorf("Error decoding %s: %w", path, e)
+	}
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if bounds.Empty() {
+		for _, frame := range anim.Image {
+			bounds = bounds.Union(frame.Bounds())
+		}
+	}
+	return &gifFrameSource{
+		name:   sourceBaseName(path),
+		anim:   anim,
+		canvas: image.NewRGBA(bounds),
+	}, nil
+}
+
+// Returns the delay after each frame, in 100ths of a second.
+func (s *gifFrameSource) delays() []int {
+	return s.anim.Delay
+}
+
+// Returns the disposal method of the given frame, or 0 if it isn't
+// specified.
+func (s *gifFrameSource) disposal(frame int) byte {
+	if frame >= len(s.anim.Disposal) {
+		return 0
+	}
+	return s.anim.Disposal[frame]
+}
+
+func (s *gifFrameSource) NextFrame() (string, image.Image, error) {
+	if s.next >= len(s.anim.Image) {
+		return "", nil, io.EOF
+	}
+	i := s.next
+	s.next++
+	if i > 0 {
+		previous := s.anim.Image[i-1].Bounds()
+		switch s.disposal(i - 1) {
+		case gif.DisposalBackground:
+			draw.Draw(s.canvas, previous, image.Transparent, image.Point{},
+				draw.Src)
+		case gif.DisposalPrevious:
+			if s.saved != nil {
+				copy(s.canvas.Pix, s.saved.Pix)
+			}
+		}
+	}
+	if s.disposal(i) == gif.DisposalPrevious {
+		if s.saved == nil {
+			s.saved = image.NewRGBA(s.canvas.Bounds())
+		}
+		copy(s.saved.Pix, s.canvas.Pix)
+	}
+	frame := s.anim.Image[i]
+	draw.Draw(s.canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+	// The canvas is modified by the next frame, so return a copy.
+	pic := image.NewRGBA(s.canvas.Bounds())
+	copy(pic.Pix, s.canvas.Pix)
+	return frameName(s.name, i+1), imageutil.Flatten(pic, imageBackground),
+		nil
+}
+
+func (s *gifFrameSource) FrameNumber() int {
+	return s.next
+}
+
+func (s *gifFrameSource) Close() error {
+	return nil
+}
+
+// Individual MJPEG frames larger than this are treated as corrupt, to avoid
+// running out of memory if a stream contains garbage.
+const maxMJPEGFrameSize = 64 * 1024 * 1024
+
+// Wrapped by the errors returned by readJPEGFrame when the stream contains a
+// corrupt frame, as opposed to when the stream itself can't be read. Reading
+// can continue after a corrupt frame.
+var errInvalidJPEG = errors.New("Invalid JPEG data")
+
+// A frameSource decoding each JPEG image in an MJPEG stream. The stream may
+// either consist of JPEG images concatenated together, or be an HTTP
+// multipart (multipart/x-mixed-replace) stream as served by many IP cameras;
+// anything between the JPEG images, such as multipart headers, is skipped.
+type mjpegFrameSource struct {
+	name   string
+	r      *bufio.Reader
+	closer io.Closer
+	frame  int
+	done   bool
+}
+
+// Opens an MJPEG stream from the given source, which may be a file path, a
+// "tcp://host:port" address, or an "http://" or "https://" URL.
+func newMJPEGFrameSource(source string) (*mjpegFrameSource, error) {
+	var stream io.ReadCloser
+	name := sourceBaseName(source)
+	switch {
+	case strings.HasPrefix(source, "tcp://"):
+		conn, e := net.Dial("tcp", strings.TrimPrefix(source, "tcp://"))
+		if e != nil {
+			return nil, fmt.Errorf("Error connecting to %s: %w", source, e)
+		}
+		stream = conn
+		name = "stream"
+	case strings.HasPrefix(source, "http://"),
+		strings.HasPrefix(source, "https://"):
+		response, e := http.Get(source)
+		if e != nil {
+			return nil, fmt.Errorf("Error requesting %s: %w", source, e)
+		}
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			return nil, fmt.Errorf("Error requesting %s: %s", source,
+				response.Status)
+		}
+		stream = response.Body
+	default:
+		f, e := os.Open(source)
+		if e != nil {
+			return nil, fmt.Errorf("Error opening %s: %w", source, e)
+		}
+		stream = f
+	}
+	return &mjpegFrameSource{
+		name:   name,
+		r:      bufio.NewReader(stream),
+		closer: stream,
+	}, nil
+}
+
+func (s *mjpegFrameSource) NextFrame() (string, image.Image, error) {
+	if s.done {
+		return "", nil, io.EOF
+	}
+	data, e := readJPEGFrame(s.r)
+	if e == io.EOF {
+		s.done = true
+		return "", nil, io.EOF
+	}
+	s.frame++
+	name := frameName(s.name, s.frame)
+	if e != nil {
+		if errors.Is(e, errInvalidJPEG) {
+			// Skip the corrupt frame. The next call will search for the
+			// start of the following one.
+			return name, nil, e
+		}
+		// The stream ended partway through a frame or failed, e.g., because
+		// the connection was lost, so there's nothing more to read.
+		s.done = true
+		if e == io.ErrUnexpectedEOF {
+			return name, nil, fmt.Errorf("The stream ended in the middle " +
+				"of a frame")
+		}
+		return name, nil, fmt.Errorf("Error reading the stream: %w", e)
+	}
+	pic, e := imageutil.Decode(bytes.NewReader(data), imageBackground)
+	if e != nil {
+		return name, nil, fmt.Errorf("Error decoding frame: %w", e)
+	}
+	return name, pic, nil
+}
+
+func (s *mjpegFrameSource) FrameNumber() int {
+	return s.frame
+}
+
+func (s *mjpegFrameSource) Close() error {
+	return s.closer.Close()
+}
+
+// Reads the next complete JPEG image from r, skipping any data before its
+// start-of-image marker. Returns io.EOF if r ends before another image
+// starts, or io.ErrUnexpectedEOF if it ends partway through one. Errors due
+// to corrupt JPEG data wrap errInvalidJPEG, and any other errors are from r.
+//
+// The end of the image can't be found by just searching for the end-of-image
+// marker, since that also appears at the end of any embedded thumbnail, so
+// this follows the JPEG segment structure.
+func readJPEGFrame(r *bufio.Reader) ([]byte, error) {
+	var previous byte
+	for {
+		b, e := r.ReadByte()
+		if e != nil {
+			return nil, e
+		}
+		if (previous == 0xff) && (b == 0xd8) {
+			break
+		}
+		previous = b
+	}
+	data := []byte{0xff, 0xd8}
+	// Returns the next byte, treating the end of the stream as an error.
+	readByte := func() (byte, error) {
+		b, e := r.ReadByte()
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return b, e
+	}
+
+	// The next marker, if it has already been read while scanning through
+	// compressed image data.
+	var marker byte
+	for {
+		if marker == 0 {
+			b, e := readByte()
+			if e != nil {
+				return nil, e
+			}
+			if b != 0xff {
+				return nil, fmt.Errorf("%w: expected a marker",
+					errInvalidJPEG)
+			}
+			marker = 0xff
+		}
+		// Markers may be preceded by any number of 0xff fill bytes.
+		for marker == 0xff {
+			b, e := readByte()
+			if e != nil {
+				return nil, e
+			}
+			marker = b
+		}
+		data = append(data, 0xff, marker)
+		current := marker
+		marker = 0
+		if current == 0xd9 {
+			return data, nil
+		}
+		if (current == 0x01) || ((current >= 0xd0) && (current <= 0xd7)) {
+			// These markers aren't followed by a segment.
+			continue
+		}
+		if current == 0xd8 {
+			return nil, fmt.Errorf("%w: unexpected start of image",
+				errInvalidJPEG)
+		}
+
+		var lengthBytes [2]byte
+		_, e := io.ReadFull(r, lengthBytes[:])
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		if e != nil {
+			return nil, e
+		}
+		length := int(lengthBytes[0])<<8 | int(lengthBytes[1])
+		if length < 2 {
+			return nil, fmt.Errorf("%w: segment length %d", errInvalidJPEG,
+				length)
+		}
+		if (len(data) + length) > maxMJPEGFrameSize {
+			return nil, fmt.Errorf("%w: frame exceeds %d bytes",
+				errInvalidJPEG, maxMJPEGFrameSize)
+		}
+		data = append(data, lengthBytes[:]...)
+		start := len(data)
+		data = append(data, make([]byte, length-2)...)
+		_, e = io.ReadFull(r, data[start:])
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		if e != nil {
+			return nil, e
+		}
+		if current != 0xda {
+			continue
+		}
+
+		// A start-of-scan segment is followed by compressed data, which
+		// continues until the next marker other than a restart marker. 0xff
+		// bytes within the compressed data are followed by a 0x00 byte.
+		for {
+			b, e := readByte()
+			if e != nil {
+				return nil, e
+			}
+			if b != 0xff {
+				data = append(data, b)
+				continue
+			}
+			next, e := readByte()
+			if e != nil {
+				return nil, e
+			}
+			if (next == 0x00) || ((next >= 0xd0) && (next <= 0xd7)) {
+				data = append(data, b, next)
+				continue
+			}
+			marker = next
+			break
+		}
+		if len(data) > maxMJPEGFrameSize {
+			return nil, fmt.Errorf("%w: frame exceeds %d bytes",
+				errInvalidJPEG, maxMJPEGFrameSize)
+		}
+	}
+}
+
+// Collects annotated copies of each image, and saves them as an animated GIF
+// when closed. Every frame is kept in memory until then, so the number of
+// frames must be limited when reading from an endless stream. Images that
+// aren't the same size as the first one are scaled to fit within it, since
+// GIF frames can't be larger than the animation.
+type animatedGIFWriter struct {
+	path string
+	// The delay after each of the source's frames, in 100ths of a second,
+	// indexed by frame number minus 1, if known (e.g., when the input is also
+	// an animated GIF).
+	delays []int
+	// The delay used for frames without an entry in delays.
+	defaultDelay int
+	anim         gif.GIF
+}
+
+func newAnimatedGIFWriter(path string, delays []int,
+	defaultDelay int) *animatedGIFWriter {
+	return &animatedGIFWriter{
+		path:         path,
+		delays:       delays,
+		defaultDelay: defaultDelay,
+	}
+}
+
+func (w *animatedGIFWriter) WriteImage(frame int, imagePath string,
+	pic image.Image, boxes []boundingBox) error {
+	annotated := drawDetections(pic, boxes)
+	if len(w.anim.Image) != 0 {
+		annotated = fitImage(annotated, w.anim.Image[0].Bounds())
+	}
+	bounds := annotated.Bounds()
+	paletted := image.NewPaletted(bounds, palette.Plan9)
+	draw.FloydSteinberg.Draw(paletted, bounds, annotated, bounds.Min)
+	// Frames that failed to load or process are missing from the output,
+	// so look up the delay by the source's frame number rather than the
+	// number of frames written.
+	delay := w.defaultDelay
+	if (frame >= 1) && (frame <= len(w.delays)) {
+		delay = w.delays[frame-1]
+	}
+	w.anim.Image = append(w.anim.Image, paletted)
+	w.anim.Delay = append(w.anim.Delay, delay)
+	return nil
+}
+
+// Returns pic if it has the given bounds. Otherwise, returns a black image
+// with the given bounds, containing a copy of pic scaled to fit within it
+// (preserving its aspect ratio) and centered.
+func fitImage(pic *image.RGBA, bounds image.Rectangle) *image.RGBA {
+	picBounds := pic.Bounds()
+	if picBounds == bounds {
+		return pic
+	}
+	scale := min(float64(bounds.Dx())/float64(picBounds.Dx()),
+		float64(bounds.Dy())/float64(picBounds.Dy()))
+	width := max(int(float64(picBounds.Dx())*scale+0.5), 1)
+	height := max(int(float64(picBounds.Dy())*scale+0.5), 1)
+	scaled := resize.Resize(uint(width), uint(height), pic, resize.Bilinear)
+	toReturn := image.NewRGBA(bounds)
+	draw.Draw(toReturn, bounds, image.Black, image.Point{}, draw.Src)
+	offset := image.Pt((bounds.Dx()-width)/2, (bounds.Dy()-height)/2)
+	r := image.Rect(0, 0, width, height).Add(bounds.Min).Add(offset)
+	draw.Draw(toReturn, r, scaled, scaled.Bounds().Min, draw.Src)
+	return toReturn
+}
+
+func (w *animatedGIFWriter) Close() error {
+	if len(w.anim.Image) == 0 {
+		return fmt.Errorf("No frames were processed successfully")
+	}
+	f, e := os.Create(w.path)
+	if e != nil {
+		return fmt.Errorf("Error creating %s: %w", w.path, e)
+	}
+	e = gif.EncodeAll(f, &w.anim)
+	if e != nil {
+		f.Close()
+		return fmt.Errorf("Error encoding %s: %w", w.path, e)
+	}
+	return f.Close()
+}
@@ -0,0 +1,207 @@
+package main
+
+// This file contains the code for running detection on overlapping tiles of
+// large images, so that small objects aren't lost when the image is scaled
+// down to the network's input size.
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"slices"
+	"sort"
+
+	"github.com/yalue/onnxruntime_go_examples/common/benchmark"
+)
+
+// Returns the rectangles of the tiles covering an image with the given
+// bounds. Each tile is tileSize x tileSize pixels (or smaller, if the image
+// itself is smaller), and adjacent tiles overlap by the given fraction of the
+// tile size. The final row and column of tiles are aligned with the image's
+// edges, so they may overlap their neighbors by more than this.
+func tileRects(bounds image.Rectangle, tileSize int,
+	overlap float64) []image.Rectangle {
+	stride := int(float64(tileSize) * (1 - overlap))
+	if stride < 1 {
+		stride = 1
+	}
+	// Returns the starting offsets of the tiles along an axis of the given
+	// length.
+	starts := func(length int) []int {
+		if length <= tileSize {
+			return []int{0}
+		}
+		var toReturn []int
+		for start := 0; ; start += stride {
+			if start+tileSize >= length {
+				toReturn = append(toReturn, length-tileSize)
+				break
+			}
+			toReturn = append(toReturn, start)
+		}
+		return toReturn
+	}
+	width, height := min(tileSize, bounds.Dx()), min(tileSize, bounds.Dy())
+	var toReturn []image.Rectangle
+	for _, y := range starts(bounds.Dy()) {
+		for _, x := range starts(bounds.Dx()) {
+			r := image.Rect(x, y, x+width, y+height)
+			toReturn = append(toReturn, r.Add(bounds.Min))
+		}
+	}
+	return toReturn
+}
+
+// Returns the part of pic within r. Avoids copying the image data if pic
+// supports SubImage, which all of the standard library's image types do.
+func cropImage(pic image.Image, r image.Rectangle) image.Image {
+	type subImager interface {
+		SubImage(r image.Rectangle) image.Image
+	}
+	if s, ok := pic.(subImager); ok {
+		return s.SubImage(r)
+	}
+	toReturn := image.NewRGBA(r)
+	draw.Draw(toReturn, r, pic, r.Min, draw.Src)
+	return toReturn
+}
+
+// Moves the box, along with its mask, keypoints and corners, by the given
+// offset.
+func (b *boundingBox) translate(dx, dy float32) {
+	b.x1 += dx
+	b.y1 += dy
+	b.x2 += dx
+	b.y2 += dy
+	if b.mask != nil {
+		b.mask.Rect = b.mask.Rect.Add(image.Pt(int(dx), int(dy)))
+	}
+	for i := range b.keypoints {
+		b.keypoints[i].x += dx
+		b.keypoints[i].y += dy
+	}
+	for i := range b.corners {
+		b.corners[i].x += dx
+		b.corners[i].y += dy
+	}
+}
+
+// Returns the area of the intersection of a and b divided by the area of the
+// smaller of the two. Unlike the IoU, this is high when a box is cut off by
+// a tile's edge and so only covers part of the box found in another tile.
+// Rotated boxes are compared using their axis-aligned bounds.
+func intersectionOverSmaller(a, b *boundingBox) float32 {
+	smaller := min(a.area(), b.area())
+	if smaller <= 0 {
+		return 0
+	}
+	return a.intersection(b) / smaller
+}
+
+// Merges boxes detected in different tiles that belong to the same object.
+// tiles[i] is the index of the tile in which boxes[i] was found. Boxes are
+// visited in order of decreasing confidence, and each is merged into an
+// earlier box from a different tile (and of the same class, unless the NMS
+// method is class-agnostic) if their intersectionOverSmaller exceeds
+// threshold. Merging grows the earlier box to cover both, unless either box
+// has a mask, keypoints or corners, which can't be combined, in which case
+// the less confident box is dropped. Boxes found in the same tile are left
+// for nonMaxSuppression.
+func mergeTileBoxes(boxes []boundingBox, tiles []int, threshold float32,
+	opts *DetectionOptions) []boundingBox {
+	order := make([]int, len(boxes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return boxes[order[i]].confidence > boxes[order[j]].confidence
+	})
+	classAware := opts.NMSMethod != NMSClassAgnostic
+	merged := make([]boundingBox, 0, len(boxes))
+	// The tiles in which each of the merged boxes' parts were found.
+	mergedTiles := make([][]int, 0, len(boxes))
+	canGrow := func(b *boundingBox) bool {
+		return (b.mask == nil) && (len(b.keypoints) == 0) &&
+			(len(b.corners) == 0)
+	}
+	for _, i := range order {
+		candidate := &boxes[i]
+		target := -1
+		for j := range merged {
+			if classAware && (merged[j].classID != candidate.classID) {
+				continue
+			}
+			if slices.Contains(mergedTiles[j], tiles[i]) {
+				continue
+			}
+			if intersectionOverSmaller(&merged[j], candidate) > threshold {
+				target = j
+				break
+			}
+		}
+		if target < 0 {
+			merged = append(merged, *candidate)
+			mergedTiles = append(mergedTiles, []int{tiles[i]})
+			continue
+		}
+		existing := &merged[target]
+		mergedTiles[target] = append(mergedTiles[target], tiles[i])
+		if canGrow(existing) && canGrow(candidate) {
+			existing.x1 = min(existing.x1, candidate.x1)
+			existing.y1 = min(existing.y1, candidate.y1)
+			existing.x2 = max(existing.x2, candidate.x2)
+			existing.y2 = max(existing.y2, candidate.y2)
+		}
+	}
+	return merged
+}
+
+// Runs detection on each of the overlapping tiles covering pic, using up to
+// d.batchSize() tiles per run of the network. The boxes found in each tile
+// are mapped back to pic's coordinates. Parts of an object found in
+// different tiles are combined using mergeTileBoxes, and the remaining boxes
+// are filtered using nonMaxSuppression. The returned transform maps pic's
+// coordinates to themselves, since the boxes have already been mapped.
+func (d *detector) detectTiled(pic image.Image) ([]boundingBox,
+	*inputTransform, error) {
+	bounds := pic.Bounds()
+	tiles := tileRects(bounds, d.tileSize, d.tileOverlap)
+	batchSize := d.batchSize()
+	var allBoxes []boundingBox
+	// The index of the tile in which each of allBoxes was found.
+	var boxTiles []int
+	for start := 0; start < len(tiles); start += batchSize {
+		d.timing.Stage(benchmark.Preprocess)
+		batchTiles := tiles[start:min(start+batchSize, len(tiles))]
+		batchPics := make([]image.Image, len(batchTiles))
+		for i, r := range batchTiles {
+			batchPics[i] = cropImage(pic, r)
+		}
+		boxes, _, e := d.detectBatch(batchPics)
+		if e != nil {
+			return nil, nil, fmt.Errorf("Error processing tiles %d to %d "+
+				"of %d: %w", start, start+len(batchTiles)-1, len(tiles), e)
+		}
+		for i, r := range batchTiles {
+			offset := r.Min.Sub(bounds.Min)
+			for j := range boxes[i] {
+				boxes[i][j].translate(float32(offset.X), float32(offset.Y))
+			}
+			allBoxes = append(allBoxes, boxes[i]...)
+			for range boxes[i] {
+				boxTiles = append(boxTiles, start+i)
+			}
+		}
+	}
+	transform := &inputTransform{
+		scaleX:         1,
+		scaleY:         1,
+		originalWidth:  bounds.Dx(),
+		originalHeight: bounds.Dy(),
+		inputWidth:     bounds.Dx(),
+		inputHeight:    bounds.Dy(),
+	}
+	allBoxes = mergeTileBoxes(allBoxes, boxTiles, d.tileMergeThreshold,
+		d.options)
+	return nonMaxSuppression(allBoxes, d.options), transform, nil
+}
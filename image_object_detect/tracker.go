@@ -0,0 +1,520 @@
+package main
+
+// This file contains a ByteTrack-style multi-object tracker, which assigns
+// stable IDs to the boxes detected in consecutive video frames. Each track's
+// motion is modeled using a constant-velocity Kalman filter, as in SORT, and
+// detections are associated with tracks by maximizing their IoU using the
+// Hungarian algorithm.
+
+import (
+	"math"
+	"sort"
+)
+
+// Controls how detections are associated with tracks.
+type TrackerOptions struct {
+	// Detections with at least this confidence may start new tracks, and are
+	// associated with tracks first.
+	HighThreshold float32
+	// Detections with a confidence between this and HighThreshold are only
+	// used to continue existing tracks, which helps to keep track of
+	// partially occluded objects. Detections below this are ignored.
+	LowThreshold float32
+	// A detection is only associated with a track if the IoU between the
+	// detection and the track's predicted box is at least this.
+	MatchIoUThreshold float32
+	// Tracks are deleted after going this many frames without being
+	// associated with a detection.
+	MaxAge int
+	// Tracks aren't reported until they've been associated with a detection
+	// in this many frames, to avoid reporting spurious tracks. (Tracks are
+	// always reported during the first MinHits frames of a sequence.)
+	MinHits int
+}
+
+// Returns the default TrackerOptions, which follow the defaults used by SORT
+// and ByteTrack.
+func DefaultTrackerOptions() *TrackerOptions {
+	return &TrackerOptions{
+		HighThreshold:     0.5,
+		LowThreshold:      0.1,
+		MatchIoUThreshold: 0.3,
+		MaxAge:            30,
+		MinHits:           3,
+	}
+}
+
+// Assigns track IDs to the boxes detected in a sequence of frames. Use
+// newTracker to create instances of this.
+type tracker struct {
+	options    *TrackerOptions
+	tracks     []*track
+	frameCount int
+	// The ID that will be assigned to the next confirmed track. Track IDs
+	// start at 1, since MOTChallenge files use 1-based IDs.
+	nextID int
+}
+
+func newTracker(options *TrackerOptions) *tracker {
+	if options == nil {
+		options = DefaultTrackerOptions()
+	}
+	return &tracker{
+		options: options,
+		nextID:  1,
+	}
+}
+
+// A single tracked object.
+type track struct {
+	// Zero until the track has been confirmed by MinHits associations.
+	id     int
+	filter *kalmanBoxFilter
+	// The most recent detection associated with this track.
+	box boundingBox
+	// The number of frames in which this track was associated with a
+	// detection.
+	hits int
+	// The number of frames since this track was last associated with a
+	// detection.
+	timeSinceUpdate int
+}
+
+// Processes the boxes detected in the next frame of the sequence, returning
+// the boxes belonging to confirmed tracks, each with its trackID set. The
+// returned boxes are in order of decreasing confidence. Boxes below the
+// options' LowThreshold should be included, since they're ignored anyway.
+func (t *tracker) Update(boxes []boundingBox) []boundingBox {
+	t.frameCount++
+	for _, tr := range t.tracks {
+		tr.filter.predict()
+		tr.timeSinceUpdate++
+	}
+
+	var high, low []*boundingBox
+	for i := range boxes {
+		b := &(boxes[i])
+		if b.confidence >= t.options.HighThreshold {
+			high = append(high, b)
+		} else if b.confidence >= t.options.LowThreshold {
+			low = append(low, b)
+		}
+	}
+
+	// First associate the confident detections with any track, then use the
+	// remaining detections to continue any tracks that are still unmatched.
+	unmatchedTracks, unmatchedHigh := t.associate(t.tracks, high)
+	t.associate(unmatchedTracks, low)
+
+	for _, b := range unmatchedHigh {
+		t.tracks = append(t.tracks, &track{
+			filter: newKalmanBoxFilter(b),
+			box:    *b,
+			hits:   1,
+		})
+	}
+
+	var toReturn []boundingBox
+	remaining := t.tracks[:0]
+	for _, tr := range t.tracks {
+		if tr.timeSinceUpdate > t.options.MaxAge {
+			continue
+		}
+		remaining = append(remaining, tr)
+		if tr.timeSinceUpdate != 0 {
+			continue
+		}
+		if (tr.hits < t.options.MinHits) &&
+			(t.frameCount > t.options.MinHits) {
+			continue
+		}
+		if tr.id == 0 {
+			tr.id = t.nextID
+			t.nextID++
+		}
+		box := tr.box
+		box.trackID = tr.id
+		toReturn = append(toReturn, box)
+	}
+	clear(t.tracks[len(remaining):])
+	t.tracks = remaining
+	sort.SliceStable(toReturn, func(i, j int) bool {
+		return toReturn[i].confidence > toReturn[j].confidence
+	})
+	return toReturn
+}
+
+// Associates the given detections with the given tracks, updating each
+// matched track. Detections are only matched with tracks of the same class.
+// Returns the tracks and detections that weren't matched.
+func (t *tracker) associate(tracks []*track,
+	detections []*boundingBox) ([]*track, []*boundingBox) {
+	if (len(tracks) == 0) || (len(detections) == 0) {
+		return tracks, detections
+	}
+	predicted := make([]boundingBox, len(tracks))
+	for i, tr := range tracks {
+		predicted[i] = tr.filter.box()
+	}
+	cost := make([][]float64, len(tracks))
+	for i := range tracks {
+		cost[i] = make([]float64, len(detections))
+		for j, d := range detections {
+			if d.classID != tracks[i].box.classID {
+				cost[i][j] = 1
+				continue
+			}
+			cost[i][j] = 1 - float64(predicted[i].iou(d))
+		}
+	}
+	assignment := solveAssignment(cost)
+
+	var unmatchedTracks []*track
+	detectionMatched := make([]bool, len(detections))
+	for i, j := range assignment {
+		tr := tracks[i]
+		if (j < 0) || (1-cost[i][j] < float64(t.options.MatchIoUThreshold)) {
+			unmatchedTracks = append(unmatchedTracks, tr)
+			continue
+		}
+		detectionMatched[j] = true
+		tr.filter.update(detections[j])
+		tr.box = *detections[j]
+		tr.hits++
+		tr.timeSinceUpdate = 0
+	}
+	var unmatchedDetections []*boundingBox
+	for j, d := range detections {
+		if !detectionMatched[j] {
+			unmatchedDetections = append(unmatchedDetections, d)
+		}
+	}
+	return unmatchedTracks, unmatchedDetections
+}
+
+// Solves the rectangular linear assignment problem using the Hungarian
+// algorithm. Returns, for each row of the cost matrix, the index of the
+// column assigned to it, or -1 if there are more rows than columns and the
+// row wasn't assigned. The sum of the costs of the assigned entries is
+// minimized.
+func solveAssignment(cost [][]float64) []int {
+	rows := len(cost)
+	if rows == 0 {
+		return nil
+	}
+	columns := len(cost[0])
+	toReturn := make([]int, rows)
+	for i := range toReturn {
+		toReturn[i] = -1
+	}
+	if columns == 0 {
+		return toReturn
+	}
+
+	// The algorithm below requires at least as many columns as rows, so
+	// transpose the matrix if necessary.
+	transposed := rows > columns
+	if transposed {
+		t := make([][]float64, columns)
+		for j := range t {
+			t[j] = make([]float64, rows)
+			for i := range cost {
+				t[j][i] = cost[i][j]
+			}
+		}
+		cost = t
+		rows, columns = columns, rows
+	}
+
+	// This follows the common O(n^2 * m) formulation using row and column
+	// potentials, with 1-based indices so that index 0 can be used as a
+	// sentinel.
+	u := make([]float64, rows+1)
+	v := make([]float64, columns+1)
+	// The row assigned to each column, or 0 if it's unassigned.
+	p := make([]int, columns+1)
+	way := make([]int, columns+1)
+	minV := make([]float64, columns+1)
+	used := make([]bool, columns+1)
+	for i := 1; i <= rows; i++ {
+		p[0] = i
+		j0 := 0
+		for j := range minV {
+			minV[j] = math.Inf(1)
+			used[j] = false
+		}
+		for {
+			used[j0] = true
+			i0 := p[j0]
+			delta := math.Inf(1)
+			j1 := 0
+			for j := 1; j <= columns; j++ {
+				if used[j] {
+					continue
+				}
+				current := cost[i0-1][j-1] - u[i0] - v[j]
+				if current < minV[j] {
+					minV[j] = current
+					way[j] = j0
+				}
+				if minV[j] < delta {
+					delta = minV[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= columns; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minV[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	for j := 1; j <= columns; j++ {
+		if p[j] == 0 {
+			continue
+		}
+		if transposed {
+			toReturn[j-1] = p[j] - 1
+		} else {
+			toReturn[p[j]-1] = j - 1
+		}
+	}
+	return toReturn
+}
+
+// A constant-velocity Kalman filter tracking a single box, using the same
+// model as SORT. The state is the box's center X and Y, its area, its aspect
+// ratio (width / height), and the velocities of the first three. The aspect
+// ratio is assumed to be constant.
+type kalmanBoxFilter struct {
+	// The state estimate, a 7x1 vector.
+	x [][]float64
+	// The state covariance, a 7x7 matrix.
+	p [][]float64
+}
+
+const (
+	kalmanStateSize       = 7
+	kalmanMeasurementSize = 4
+)
+
+// Returns a new filter with its initial state set from the given box, with a
+// high uncertainty for the (unobserved) velocities.
+func newKalmanBoxFilter(b *boundingBox) *kalmanBoxFilter {
+	toReturn := &kalmanBoxFilter{
+		x: newMatrix(kalmanStateSize, 1),
+		p: identityMatrix(kalmanStateSize),
+	}
+	z := boxToMeasurement(b)
+	for i := 0; i < kalmanMeasurementSize; i++ {
+		toReturn.x[i][0] = z[i][0]
+		toReturn.p[i][i] = 10
+	}
+	for i := kalmanMeasurementSize; i < kalmanStateSize; i++ {
+		toReturn.p[i][i] = 10000
+	}
+	return toReturn
+}
+
+// Converts a box to the [center X, center Y, area, aspect ratio] measurement
+// vector used by kalmanBoxFilter.
+func boxToMeasurement(b *boundingBox) [][]float64 {
+	w := float64(b.x2 - b.x1)
+	h := float64(b.y2 - b.y1)
+	z := newMatrix(kalmanMeasurementSize, 1)
+	z[0][0] = float64(b.x1) + w/2
+	z[1][0] = float64(b.y1) + h/2
+	z[2][0] = w * h
+	if h > 0 {
+		z[3][0] = w / h
+	}
+	return z
+}
+
+// Returns the box corresponding to the filter's current state estimate.
+func (f *kalmanBoxFilter) box() boundingBox {
+	area := math.Max(f.x[2][0], 0)
+	w := math.Sqrt(area * math.Max(f.x[3][0], 0))
+	h := 0.0
+	if w > 0 {
+		h = area / w
+	}
+	cx, cy := f.x[0][0], f.x[1][0]
+	return boundingBox{
+		x1: float32(cx - w/2),
+		y1: float32(cy - h/2),
+		x2: float32(cx + w/2),
+		y2: float32(cy + h/2),
+	}
+}
+
+// The state transition matrix, which adds each velocity to its
+// corresponding value.
+func kalmanTransition() [][]float64 {
+	f := identityMatrix(kalmanStateSize)
+	f[0][4] = 1
+	f[1][5] = 1
+	f[2][6] = 1
+	return f
+}
+
+// Advances the filter's state by one frame.
+func (f *kalmanBoxFilter) predict() {
+	// Don't allow the area to become negative.
+	if (f.x[2][0] + f.x[6][0]) <= 0 {
+		f.x[6][0] = 0
+	}
+	transition := kalmanTransition()
+	f.x = matrixMultiply(transition, f.x)
+	f.p = matrixMultiply(matrixMultiply(transition, f.p),
+		matrixTranspose(transition))
+	// Add the process noise. The velocities are assumed to change slowly,
+	// especially the rate of change of the area.
+	noise := []float64{1, 1, 1, 1, 0.01, 0.01, 0.0001}
+	for i, n := range noise {
+		f.p[i][i] += n
+	}
+}
+
+// Corrects the filter's state using a box observed in the current frame.
+func (f *kalmanBoxFilter) update(b *boundingBox) {
+	z := boxToMeasurement(b)
+	// The measurement matrix simply selects the first four state values, so
+	// the products involving it reduce to taking submatrices.
+	y := newMatrix(kalmanMeasurementSize, 1)
+	for i := range y {
+		y[i][0] = z[i][0] - f.x[i][0]
+	}
+	// S = HPH' + R, where the measurement noise R is larger for the area and
+	// aspect ratio.
+	s := newMatrix(kalmanMeasurementSize, kalmanMeasurementSize)
+	for i := range s {
+		copy(s[i], f.p[i][:kalmanMeasurementSize])
+	}
+	measurementNoise := []float64{1, 1, 10, 10}
+	for i, n := range measurementNoise {
+		s[i][i] += n
+	}
+	sInverse := matrixInverse(s)
+	if sInverse == nil {
+		return
+	}
+	// K = PH'S^-1
+	pht := newMatrix(kalmanStateSize, kalmanMeasurementSize)
+	for i := range pht {
+		copy(pht[i], f.p[i][:kalmanMeasurementSize])
+	}
+	k := matrixMultiply(pht, sInverse)
+	ky := matrixMultiply(k, y)
+	for i := range f.x {
+		f.x[i][0] += ky[i][0]
+	}
+	// P = (I - KH)P
+	ikh := identityMatrix(kalmanStateSize)
+	for i := 0; i < kalmanStateSize; i++ {
+		for j := 0; j < kalmanMeasurementSize; j++ {
+			ikh[i][j] -= k[i][j]
+		}
+	}
+	f.p = matrixMultiply(ikh, f.p)
+}
+
+func newMatrix(rows, columns int) [][]float64 {
+	toReturn := make([][]float64, rows)
+	for i := range toReturn {
+		toReturn[i] = make([]float64, columns)
+	}
+	return toReturn
+}
+
+func identityMatrix(size int) [][]float64 {
+	toReturn := newMatrix(size, size)
+	for i := range toReturn {
+		toReturn[i][i] = 1
+	}
+	return toReturn
+}
+
+func matrixMultiply(a, b [][]float64) [][]float64 {
+	toReturn := newMatrix(len(a), len(b[0]))
+	for i := range a {
+		for k := range b {
+			v := a[i][k]
+			if v == 0 {
+				continue
+			}
+			for j := range b[k] {
+				toReturn[i][j] += v * b[k][j]
+			}
+		}
+	}
+	return toReturn
+}
+
+func matrixTranspose(m [][]float64) [][]float64 {
+	toReturn := newMatrix(len(m[0]), len(m))
+	for i := range m {
+		for j := range m[i] {
+			toReturn[j][i] = m[i][j]
+		}
+	}
+	return toReturn
+}
+
+// Returns the inverse of a square matrix using Gauss-Jordan elimination, or
+// nil if the matrix is singular.
+func matrixInverse(m [][]float64) [][]float64 {
+	n := len(m)
+	// Augment a copy of m with the identity matrix.
+	a := newMatrix(n, 2*n)
+	for i := range m {
+		copy(a[i], m[i])
+		a[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return nil
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		scale := a[col][col]
+		for j := range a[col] {
+			a[col][j] /= scale
+		}
+		for row := 0; row < n; row++ {
+			if row == col {
+				continue
+			}
+			factor := a[row][col]
+			if factor == 0 {
+				continue
+			}
+			for j := range a[row] {
+				a[row][j] -= factor * a[col][j]
+			}
+		}
+	}
+	toReturn := newMatrix(n, n)
+	for i := range toReturn {
+		copy(toReturn[i], a[i][n:])
+	}
+	return toReturn
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Returns the lowest total cost of assigning min(rows, columns) rows to
+// distinct columns, by trying every possible assignment.
+func bruteForceAssignmentCost(cost [][]float64) float64 {
+	rows := len(cost)
+	if rows == 0 {
+		return 0
+	}
+	columns := len(cost[0])
+	usedColumns := make([]bool, columns)
+	best := math.Inf(1)
+	// Assigns rows starting at row, skipping up to skipsLeft rows when there
+	// are more rows than columns.
+	var search func(row, skipsLeft int, total float64)
+	search = func(row, skipsLeft int, total float64) {
+		if row == rows {
+			best = min(best, total)
+			return
+		}
+		if skipsLeft > 0 {
+			search(row+1, skipsLeft-1, total)
+		}
+		for j := 0; j < columns; j++ {
+			if usedColumns[j] {
+				continue
+			}
+			usedColumns[j] = true
+			search(row+1, skipsLeft, total+cost[row][j])
+			usedColumns[j] = false
+		}
+	}
+	search(0, max(rows-columns, 0), 0)
+	return best
+}
+
+// Checks that assignment is a valid, optimal solution for cost.
+func checkAssignment(t *testing.T, name string, cost [][]float64,
+	assignment []int) {
+	if len(assignment) != len(cost) {
+		t.Fatalf("%s: expected %d assignments, got %d", name, len(cost),
+			len(assignment))
+	}
+	columns := len(cost[0])
+	usedColumns := make(map[int]bool)
+	assigned := 0
+	total := 0.0
+	for i, j := range assignment {
+		if j < 0 {
+			continue
+		}
+		if j >= columns {
+			t.Fatalf("%s: row %d was assigned invalid column %d", name, i, j)
+		}
+		if usedColumns[j] {
+			t.Fatalf("%s: column %d was assigned more than once", name, j)
+		}
+		usedColumns[j] = true
+		assigned++
+		total += cost[i][j]
+	}
+	if assigned != min(len(cost), columns) {
+		t.Fatalf("%s: expected %d rows to be assigned, got %d", name,
+			min(len(cost), columns), assigned)
+	}
+	expected := bruteForceAssignmentCost(cost)
+	if math.Abs(total-expected) > 1e-9 {
+		t.Fatalf("%s: got an assignment %v costing %f, but the optimal "+
+			"cost is %f", name, assignment, total, expected)
+	}
+}
+
+func TestSolveAssignment(t *testing.T) {
+	tests := []struct {
+		name string
+		cost [][]float64
+	}{
+		{"1x1", [][]float64{{0.5}}},
+		{"square", [][]float64{
+			{4, 1, 3},
+			{2, 0, 5},
+			{3, 2, 2},
+		}},
+		{"greedy is suboptimal", [][]float64{
+			{1, 2},
+			{2, 100},
+		}},
+		{"fewer rows than columns", [][]float64{
+			{7, 3, 9, 1},
+			{2, 8, 4, 6},
+		}},
+		{"more rows than columns", [][]float64{
+			{7, 2},
+			{3, 8},
+			{9, 4},
+			{1, 6},
+		}},
+		{"all tied", [][]float64{
+			{1, 1, 1},
+			{1, 1, 1},
+			{1, 1, 1},
+		}},
+		{"partly tied", [][]float64{
+			{0, 0, 1},
+			{0, 0, 1},
+			{1, 1, 0},
+		}},
+		{"tied, more rows than columns", [][]float64{
+			{0.5, 0.5},
+			{0.5, 0.5},
+			{0.5, 0.5},
+		}},
+	}
+	for _, test := range tests {
+		checkAssignment(t, test.name, test.cost, solveAssignment(test.cost))
+	}
+
+	// Also check random matrices of every shape up to 5x5. The costs are
+	// rounded to tenths, as 1 - IoU values often are, so ties are common.
+	rng := rand.New(rand.NewSource(1337))
+	for rows := 1; rows <= 5; rows++ {
+		for columns := 1; columns <= 5; columns++ {
+			for n := 0; n < 20; n++ {
+				cost := make([][]float64, rows)
+				for i := range cost {
+					cost[i] = make([]float64, columns)
+					for j := range cost[i] {
+						cost[i][j] = float64(rng.Intn(11)) / 10
+					}
+				}
+				checkAssignment(t, "random", cost, solveAssignment(cost))
+			}
+		}
+	}
+}
+
+func TestSolveAssignmentEmpty(t *testing.T) {
+	if a := solveAssignment(nil); len(a) != 0 {
+		t.Fatalf("Expected no assignments for an empty matrix, got %v", a)
+	}
+	a := solveAssignment([][]float64{{}, {}})
+	if (len(a) != 2) || (a[0] != -1) || (a[1] != -1) {
+		t.Fatalf("Expected two unassigned rows, got %v", a)
+	}
+}
+
+func TestKalmanBoxFilterConstantVelocity(t *testing.T) {
+	const vx, vy = 5, -2
+	box := boundingBox{x1: 100, y1: 200, x2: 140, y2: 260}
+	f := newKalmanBoxFilter(&box)
+	for frame := 0; frame < 40; frame++ {
+		box.translate(vx, vy)
+		f.predict()
+		f.update(&box)
+	}
+	if (math.Abs(f.x[4][0]-vx) > 0.1) || (math.Abs(f.x[5][0]-vy) > 0.1) {
+		t.Fatalf("Expected a velocity of (%d, %d), got (%f, %f)", vx, vy,
+			f.x[4][0], f.x[5][0])
+	}
+	if math.Abs(f.x[6][0]) > 0.1 {
+		t.Fatalf("Expected the area to stay constant, but its velocity is %f",
+			f.x[6][0])
+	}
+
+	// The prediction for the next frame should be where the box moves to.
+	f.predict()
+	box.translate(vx, vy)
+	predicted := f.box()
+	if iou := predicted.iou(&box); iou < 0.95 {
+		t.Fatalf("Predicted box %s only has an IoU of %f with the actual "+
+			"box %s", predicted.String(), iou, box.String())
+	}
+}
+
+func TestTrackerUpdate(t *testing.T) {
+	objects := newTracker(&TrackerOptions{
+		HighThreshold:     0.5,
+		LowThreshold:      0.1,
+		MatchIoUThreshold: 0.3,
+		MaxAge:            2,
+		MinHits:           1,
+	})
+	// Two objects moving towards each other, without overlapping.
+	boxAt := func(x float32) boundingBox {
+		return boundingBox{confidence: 0.9, x1: x, y1: 50, x2: x + 40,
+			y2: 130}
+	}
+	// The track ID of each object, by its index.
+	ids := make(map[int]int)
+	for frame := 0; frame < 10; frame++ {
+		offset := float32(frame * 4)
+		boxes := []boundingBox{boxAt(10 + offset), boxAt(300 - offset)}
+		tracked := objects.Update(boxes)
+		if len(tracked) != 2 {
+			t.Fatalf("Expected 2 tracked boxes in frame %d, got %d", frame,
+				len(tracked))
+		}
+		for _, b := range tracked {
+			// Identify the object by which side of the image it's on.
+			object := 0
+			if b.x1 > 150 {
+				object = 1
+			}
+			if b.trackID == 0 {
+				t.Fatalf("Box %s in frame %d has no track ID", b.String(),
+					frame)
+			}
+			if ids[object] == 0 {
+				ids[object] = b.trackID
+			}
+			if b.trackID != ids[object] {
+				t.Fatalf("Object %d's track ID changed from %d to %d in "+
+					"frame %d", object, ids[object], b.trackID, frame)
+			}
+		}
+	}
+	if ids[0] == ids[1] {
+		t.Fatalf("Both objects have track ID %d", ids[0])
+	}
+
+	// Once the second object disappears, its track should be removed after
+	// MaxAge frames, while the first object keeps its ID.
+	for frame := 10; frame < 14; frame++ {
+		tracked := objects.Update([]boundingBox{boxAt(float32(10 +
+			frame*4))})
+		if (len(tracked) != 1) || (tracked[0].trackID != ids[0]) {
+			t.Fatalf("Expected only track %d in frame %d, got %v", ids[0],
+				frame, tracked)
+		}
+	}
+	if len(objects.tracks) != 1 {
+		t.Fatalf("Expected the lost track to be removed, but there are "+
+			"still %d tracks", len(objects.tracks))
+	}
+
+	// An object appearing later gets a new ID.
+	tracked := objects.Update([]boundingBox{boxAt(66), boxAt(400)})
+	for _, b := range tracked {
+		if (b.x1 > 150) && ((b.trackID == ids[0]) || (b.trackID == ids[1])) {
+			t.Fatalf("A new object reused track ID %d", b.trackID)
+		}
+	}
+}
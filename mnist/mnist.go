@@ -11,42 +11,18 @@ import (
 	"flag"
 	"fmt"
 	ort "github.com/yalue/onnxruntime_go"
+	"github.com/yalue/onnxruntime_go_examples/common/benchmark"
+	"github.com/yalue/onnxruntime_go_examples/common/imageutil"
+	"github.com/yalue/onnxruntime_go_examples/common/ortlib"
+	"github.com/yalue/onnxruntime_go_examples/common/sessionopts"
 	"image"
 	"image/color"
 	_ "image/gif"
 	_ "image/jpeg"
 	"image/png"
 	"os"
-	"runtime"
 )
 
-// For more comments, see the sum_and_difference example.
-func getDefaultSharedLibPath() string {
-	if runtime.GOOS == "windows" {
-		if runtime.GOARCH == "amd64" {
-			return "../third_party/onnxruntime.dll"
-		}
-	}
-	if runtime.GOOS == "darwin" {
-		if runtime.GOARCH == "arm64" {
-			return "../third_party/onnxruntime_arm64.dylib"
-		}
-		if runtime.GOARCH == "amd64" {
-			return "../third_party/onnxruntime_amd64.dylib"
-		}
-	}
-	if runtime.GOOS == "linux" {
-		if runtime.GOARCH == "arm64" {
-			return "../third_party/onnxruntime_arm64.so"
-		}
-		return "../third_party/onnxruntime.so"
-	}
-	fmt.Printf("Unable to determine a path to the onnxruntime shared library"+
-		" for OS \"%s\" and architecture \"%s\".\n", runtime.GOOS,
-		runtime.GOARCH)
-	return ""
-}
-
 // Implements the color interface
 type grayscaleFloat float32
 
@@ -138,16 +114,13 @@ func (p *ProcessedImage) GetNetworkInput() []float32 {
 
 // Takes a path to an image file, loads the image, and returns a ProcessedImage
 // struct which can be used to obtain the neural network input.
-func NewProcessedImage(path string, invertBrightness bool) (*ProcessedImage,
-	error) {
-	f, e := os.Open(path)
-	if e != nil {
-		return nil, fmt.Errorf("Error opening %s: %w", path, e)
-	}
-	defer f.Close()
-	originalPic, _, e := image.Decode(f)
+func NewProcessedImage(path string, invertBrightness bool,
+	background color.Color) (*ProcessedImage, error) {
+	// This applies the image's EXIF orientation, and composites transparent
+	// pixels onto the background rather than letting them become black.
+	originalPic, e := imageutil.Load(path, background)
 	if e != nil {
-		return nil, fmt.Errorf("Error decoding image %s: %w", path, e)
+		return nil, e
 	}
 	bounds := originalPic.Bounds().Canon()
 	if (bounds.Min.X != 0) || (bounds.Min.Y != 0) {
@@ -163,6 +136,20 @@ func NewProcessedImage(path string, invertBrightness bool) (*ProcessedImage,
 	}, nil
 }
 
+// Returns the index of the largest value in the network's output, i.e., the
+// most likely digit, along with its value.
+func mostLikelyDigit(outputs []float32) (int, float32) {
+	maxIndex := 0
+	maxProbability := float32(-1.0e9)
+	for i, v := range outputs {
+		if v > maxProbability {
+			maxProbability = v
+			maxIndex = i
+		}
+	}
+	return maxIndex, maxProbability
+}
+
 // Attempts to save the given image as a png.
 func saveImage(pic image.Image, path string) error {
 	f, e := os.Create(path)
@@ -177,16 +164,42 @@ func saveImage(pic image.Image, path string) error {
 	return nil
 }
 
+// Repeatedly runs the network on the input image, timing the conversion of
+// the image into network inputs, the network itself, and finding the most
+// likely digit. The given session must use the given input and output
+// tensors.
+func runBenchmark(benchmarkConfig *benchmark.Config, inputImage *ProcessedImage,
+	session *ort.AdvancedSession, input, output *ort.Tensor[float32]) error {
+	timer := benchmark.NewTimer()
+	result, e := benchmarkConfig.Run("mnist", timer, 1, func() error {
+		timer.Stage(benchmark.Preprocess)
+		copy(input.GetData(), inputImage.GetNetworkInput())
+		timer.Stage(benchmark.Inference)
+		e := session.Run()
+		if e != nil {
+			return fmt.Errorf("Error running the MNIST network: %w", e)
+		}
+		timer.Stage(benchmark.Postprocess)
+		mostLikelyDigit(output.GetData())
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+	return benchmarkConfig.Report(result, os.Stdout)
+}
+
 // Takes a path to the onnxruntime shared library as well as the image file
 // containing a digit to be classified. The image file will be processed into
 // the format expected by the .onnx network.
 //
 // If the network runs successfully, this will print the classification results
-// to stdout.
+// to stdout, followed by the benchmark results if -benchmark was set.
 func classifyDigit(onnxruntimeLibPath, imagePath string,
-	invertBrightness bool) error {
-	ort.SetSharedLibraryPath(onnxruntimeLibPath)
-	e := ort.InitializeEnvironment()
+	invertBrightness bool, background color.Color,
+	sessionConfig *sessionopts.Config,
+	benchmarkConfig *benchmark.Config) error {
+	_, e := ortlib.Initialize(onnxruntimeLibPath)
 	if e != nil {
 		return fmt.Errorf("Error initializing the onnxruntime library: %w", e)
 	}
@@ -194,7 +207,8 @@ func classifyDigit(onnxruntimeLibPath, imagePath string,
 
 	// Load the input image and save the postprocessed version for a visual
 	// inspection.
-	inputImage, e := NewProcessedImage(imagePath, invertBrightness)
+	inputImage, e := NewProcessedImage(imagePath, invertBrightness,
+		background)
 	if e != nil {
 		return fmt.Errorf("Error loading input image: %w", e)
 	}
@@ -223,11 +237,17 @@ func classifyDigit(onnxruntimeLibPath, imagePath string,
 	}
 	defer output.Destroy()
 
+	options, onnxPath, e := sessionConfig.NewSessionOptions("./mnist.onnx")
+	if e != nil {
+		return fmt.Errorf("Error creating session options: %w", e)
+	}
+	defer options.Destroy()
+
 	// The input and output names are required by this network; they can be
 	// found on the MNIST ONNX models page linked in the README.
-	session, e := ort.NewAdvancedSession("./mnist.onnx",
+	session, e := ort.NewAdvancedSession(onnxPath,
 		[]string{"Input3"}, []string{"Plus214_Output_0"},
-		[]ort.Value{input}, []ort.Value{output}, nil)
+		[]ort.Value{input}, []ort.Value{output}, options)
 	if e != nil {
 		return fmt.Errorf("Error creating MNIST network session: %w", e)
 	}
@@ -241,38 +261,44 @@ func classifyDigit(onnxruntimeLibPath, imagePath string,
 
 	fmt.Printf("Output probabilities:\n")
 	outputData := output.GetData()
-	maxIndex := 0
-	maxProbability := float32(-1.0e9)
 	for i, v := range outputData {
 		fmt.Printf("  %d: %f\n", i, v)
-		if v > maxProbability {
-			maxProbability = v
-			maxIndex = i
-		}
 	}
+	maxIndex, maxProbability := mostLikelyDigit(outputData)
 	fmt.Printf("%s is probably a %d, with probability %f\n", imagePath,
 		maxIndex, maxProbability)
-
-	return nil
+	if !benchmarkConfig.Enabled() {
+		return nil
+	}
+	return runBenchmark(benchmarkConfig, inputImage, session, input, output)
 }
 
 func run() int {
-	var onnxruntimeLibPath string
 	var imagePath string
 	var invertImage bool
-	flag.StringVar(&onnxruntimeLibPath, "onnxruntime_lib",
-		getDefaultSharedLibPath(),
-		"The path to the onnxruntime shared library for your system.")
+	var backgroundName string
+	onnxruntimeLibPath := ortlib.AddFlag()
+	sessionConfig := sessionopts.AddFlags()
+	benchmarkConfig := benchmark.AddFlags()
 	flag.StringVar(&imagePath, "image_path", "",
 		"The image containing a digit to classify.")
 	flag.BoolVar(&invertImage, "invert_image", false,
 		"If set, the image's colors will be inverted before processing. "+
 			"The network expects inputs with dark backgrounds, so you should "+
 			"set this to true for images with light backgrounds.")
+	flag.StringVar(&backgroundName, "background", "white",
+		"The color onto which transparent pixels in the image are "+
+			"composited, as \"#rrggbb\" or one of \"white\", \"black\" or "+
+			"\"gray\".")
 	flag.Parse()
-	if onnxruntimeLibPath == "" {
-		fmt.Println("You must specify a path to the onnxruntime shared " +
-			"on your system. Run with -help for more information.")
+	e := sessionConfig.Validate()
+	if e != nil {
+		fmt.Printf("Invalid session settings: %s\n", e)
+		return 1
+	}
+	e = benchmarkConfig.Validate()
+	if e != nil {
+		fmt.Printf("Invalid benchmark settings: %s\n", e)
 		return 1
 	}
 	if imagePath == "" {
@@ -280,7 +306,13 @@ func run() int {
 			"more information.")
 		return 1
 	}
-	e := classifyDigit(onnxruntimeLibPath, imagePath, invertImage)
+	background, e := imageutil.ParseColor(backgroundName)
+	if e != nil {
+		fmt.Printf("Invalid -background setting: %s\n", e)
+		return 1
+	}
+	e = classifyDigit(*onnxruntimeLibPath, imagePath, invertImage,
+		background, sessionConfig, benchmarkConfig)
 	if e != nil {
 		fmt.Printf("Error running network: %s\n", e)
 		return 1
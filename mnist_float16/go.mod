@@ -5,4 +5,7 @@ go 1.20
 require (
 	github.com/x448/float16 v0.8.4
 	github.com/yalue/onnxruntime_go v1.25.0
+	github.com/yalue/onnxruntime_go_examples/common v0.0.0
 )
+
+replace github.com/yalue/onnxruntime_go_examples/common => ../common
@@ -7,49 +7,28 @@ import (
 	"flag"
 	"fmt"
 	ort "github.com/yalue/onnxruntime_go"
+	"github.com/yalue/onnxruntime_go_examples/common/benchmark"
+	"github.com/yalue/onnxruntime_go_examples/common/ortlib"
+	"github.com/yalue/onnxruntime_go_examples/common/sessionopts"
 	"os"
-	"runtime"
 )
 
-// For more comments, see the sum_and_difference example.
-func getDefaultSharedLibPath() string {
-	if runtime.GOOS == "windows" {
-		if runtime.GOARCH == "amd64" {
-			return "../third_party/onnxruntime.dll"
-		}
-	}
-	if runtime.GOOS == "darwin" {
-		if runtime.GOARCH == "arm64" {
-			return "../third_party/onnxruntime_arm64.dylib"
-		}
-		if runtime.GOARCH == "amd64" {
-			return "../third_party/onnxruntime_amd64.dylib"
-		}
-	}
-	if runtime.GOOS == "linux" {
-		if runtime.GOARCH == "arm64" {
-			return "../third_party/onnxruntime_arm64.so"
-		}
-		return "../third_party/onnxruntime.so"
-	}
-	fmt.Printf("Unable to determine a path to the onnxruntime shared library"+
-		" for OS \"%s\" and architecture \"%s\".\n", runtime.GOOS,
-		runtime.GOARCH)
-	return ""
-}
-
 func run() int {
-	var onnxruntimeLibPath string
-	flag.StringVar(&onnxruntimeLibPath, "onnxruntime_lib",
-		getDefaultSharedLibPath(),
-		"The path to the onnxruntime shared library for your system.")
+	onnxruntimeLibPath := ortlib.AddFlag()
+	sessionConfig := sessionopts.AddFlags()
+	benchmarkConfig := benchmark.AddFlags()
 	flag.Parse()
-	if onnxruntimeLibPath == "" {
-		fmt.Println("You must specify a path to the onnxruntime shared " +
-			"on your system. Run with -help for more information.")
+	e := sessionConfig.Validate()
+	if e != nil {
+		fmt.Printf("Invalid session settings: %s\n", e)
+		return 1
+	}
+	e = benchmarkConfig.Validate()
+	if e != nil {
+		fmt.Printf("Invalid benchmark settings: %s\n", e)
 		return 1
 	}
-	e := runSklearnNetwork(onnxruntimeLibPath)
+	e = runSklearnNetwork(*onnxruntimeLibPath, sessionConfig, benchmarkConfig)
 	if e != nil {
 		fmt.Printf("Encountered an error running the network: %s\n", e)
 		return 1
@@ -61,20 +40,25 @@ func main() {
 	os.Exit(run())
 }
 
-func runSklearnNetwork(sharedLibPath string) error {
-	ort.SetSharedLibraryPath(sharedLibPath)
-	e := ort.InitializeEnvironment()
+func runSklearnNetwork(sharedLibPath string, sessionConfig *sessionopts.Config,
+	benchmarkConfig *benchmark.Config) error {
+	_, e := ortlib.Initialize(sharedLibPath)
 	if e != nil {
 		return fmt.Errorf("Error initializing onnxruntime library: %w", e)
 	}
 
 	// Load the session. We'll use DynamicAdvancedSession so that onnxruntime
 	// can automatically allocate the more complicated outputs for us.
-	modelPath := "./sklearn_randomforest.onnx"
+	options, modelPath, e := sessionConfig.NewSessionOptions(
+		"./sklearn_randomforest.onnx")
+	if e != nil {
+		return fmt.Errorf("Error creating session options: %w", e)
+	}
+	defer options.Destroy()
 	inputNames := []string{"X"}
 	outputNames := []string{"output_label", "output_probability"}
 	session, e := ort.NewDynamicAdvancedSession(modelPath, inputNames,
-		outputNames, nil)
+		outputNames, options)
 	if e != nil {
 		return fmt.Errorf("Error loading %s: %w", modelPath, e)
 	}
@@ -152,5 +136,55 @@ func runSklearnNetwork(sharedLibPath string) error {
 			fmt.Printf("   Label %d: %f\n", key, value)
 		}
 	}
+	if !benchmarkConfig.Enabled() {
+		return nil
+	}
+	return runBenchmark(benchmarkConfig, session, inputTensor, inputValues)
+}
+
+// Repeatedly runs the network on the six input vectors. Copying the input
+// values into the input tensor counts as preprocessing, and reading the
+// contents of the auto-allocated outputs (and destroying them) counts as
+// postprocessing.
+func runBenchmark(benchmarkConfig *benchmark.Config,
+	session *ort.DynamicAdvancedSession, inputTensor *ort.Tensor[float32],
+	inputValues []float32) error {
+	timer := benchmark.NewTimer()
+	inputs := []ort.Value{inputTensor}
+	result, e := benchmarkConfig.Run("non_tensor_outputs", timer, 6,
+		func() error {
+			timer.Stage(benchmark.Preprocess)
+			copy(inputTensor.GetData(), inputValues)
+			timer.Stage(benchmark.Inference)
+			outputValues := []ort.Value{nil, nil}
+			e := session.Run(inputs, outputValues)
+			if e != nil {
+				return fmt.Errorf("Error running the network: %w", e)
+			}
+			defer outputValues[0].Destroy()
+			defer outputValues[1].Destroy()
+			timer.Stage(benchmark.Postprocess)
+			return readProbabilities(outputValues[1].(*ort.Sequence))
+		})
+	if e != nil {
+		return e
+	}
+	return benchmarkConfig.Report(result, os.Stdout)
+}
+
+// Reads every key and value from the sequence of maps produced by the
+// network's second output, discarding them. Used when benchmarking.
+func readProbabilities(sequence *ort.Sequence) error {
+	probabilityMaps, e := sequence.GetValues()
+	if e != nil {
+		return fmt.Errorf("Error getting contents of sequence: %w", e)
+	}
+	for i := range probabilityMaps {
+		_, _, e := probabilityMaps[i].(*ort.Map).GetKeysAndValues()
+		if e != nil {
+			return fmt.Errorf("Error getting keys and values for map at "+
+				"index %d: %w", i, e)
+		}
+	}
 	return nil
 }
@@ -6,41 +6,13 @@ import (
 	"flag"
 	"fmt"
 	ort "github.com/yalue/onnxruntime_go"
+	"github.com/yalue/onnxruntime_go_examples/common/ortlib"
 	"os"
-	"runtime"
 )
 
-// For more comments, see the sum_and_difference example.
-func getDefaultSharedLibPath() string {
-	if runtime.GOOS == "windows" {
-		if runtime.GOARCH == "amd64" {
-			return "../third_party/onnxruntime.dll"
-		}
-	}
-	if runtime.GOOS == "darwin" {
-		if runtime.GOARCH == "arm64" {
-			return "../third_party/onnxruntime_arm64.dylib"
-		}
-		if runtime.GOARCH == "amd64" {
-			return "../third_party/onnxruntime_amd64.dylib"
-		}
-	}
-	if runtime.GOOS == "linux" {
-		if runtime.GOARCH == "arm64" {
-			return "../third_party/onnxruntime_arm64.so"
-		}
-		return "../third_party/onnxruntime.so"
-	}
-	fmt.Printf("Unable to determine a path to the onnxruntime shared library"+
-		" for OS \"%s\" and architecture \"%s\".\n", runtime.GOOS,
-		runtime.GOARCH)
-	return ""
-}
-
 // Prints the inputs and outputs of an onnx-format network to stdout.
 func showNetworkInputsAndOutputs(libPath, networkPath string) error {
-	ort.SetSharedLibraryPath(libPath)
-	e := ort.InitializeEnvironment()
+	_, e := ortlib.Initialize(libPath)
 	if e != nil {
 		return fmt.Errorf("Error initializing onnxruntime library: %w", e)
 	}
@@ -61,25 +33,17 @@ func showNetworkInputsAndOutputs(libPath, networkPath string) error {
 }
 
 func run() int {
-	var onnxruntimeLibPath string
 	var onnxNetworkPath string
-	flag.StringVar(&onnxruntimeLibPath, "onnxruntime_lib",
-		getDefaultSharedLibPath(),
-		"The path to the onnxruntime shared library for your system.")
+	onnxruntimeLibPath := ortlib.AddFlag()
 	flag.StringVar(&onnxNetworkPath, "onnx_file", "",
 		"The path to the .onnx file to load.")
 	flag.Parse()
-	if onnxruntimeLibPath == "" {
-		fmt.Println("You must specify a path to the onnxruntime shared " +
-			"on your system. Run with -help for more information.")
-		return 1
-	}
 	if onnxNetworkPath == "" {
 		fmt.Println("You must specify a .onnx network to list the inputs and" +
 			" outputs for. Run with -help for more information.")
 		return 1
 	}
-	e := showNetworkInputsAndOutputs(onnxruntimeLibPath, onnxNetworkPath)
+	e := showNetworkInputsAndOutputs(*onnxruntimeLibPath, onnxNetworkPath)
 	if e != nil {
 		fmt.Printf("Error getting network inputs and outputs: %s\n", e)
 		return 1
@@ -2,4 +2,9 @@ module github.com/yalue/onnxruntime_go_examples/string_tensor
 
 go 1.20
 
-require github.com/yalue/onnxruntime_go v1.25.0
+require (
+	github.com/yalue/onnxruntime_go v1.25.0
+	github.com/yalue/onnxruntime_go_examples/common v0.0.0
+)
+
+replace github.com/yalue/onnxruntime_go_examples/common => ../common
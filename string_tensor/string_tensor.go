@@ -9,44 +9,20 @@ import (
 	"flag"
 	"fmt"
 	ort "github.com/yalue/onnxruntime_go"
+	"github.com/yalue/onnxruntime_go_examples/common/benchmark"
+	"github.com/yalue/onnxruntime_go_examples/common/ortlib"
+	"github.com/yalue/onnxruntime_go_examples/common/sessionopts"
 	"os"
-	"runtime"
 )
 
-// For more comments, see the sum_and_difference example.
-func getDefaultSharedLibPath() string {
-	if runtime.GOOS == "windows" {
-		if runtime.GOARCH == "amd64" {
-			return "../third_party/onnxruntime.dll"
-		}
-	}
-	if runtime.GOOS == "darwin" {
-		if runtime.GOARCH == "arm64" {
-			return "../third_party/onnxruntime_arm64.dylib"
-		}
-		if runtime.GOARCH == "amd64" {
-			return "../third_party/onnxruntime_amd64.dylib"
-		}
-	}
-	if runtime.GOOS == "linux" {
-		if runtime.GOARCH == "arm64" {
-			return "../third_party/onnxruntime_arm64.so"
-		}
-		return "../third_party/onnxruntime.so"
-	}
-	fmt.Printf("Unable to determine a path to the onnxruntime shared library"+
-		" for OS \"%s\" and architecture \"%s\".\n", runtime.GOOS,
-		runtime.GOARCH)
-	return ""
-}
-
 // Takes a path to the onnxruntime shared library as well as the string that
 // will be used as an input to the network. If the network runs successfully,
 // it will convert the string to upper and lowercase, and print the results to
-// stdout.
-func printUpperAndLowercase(onnxruntimeLibPath, inputString string) error {
-	ort.SetSharedLibraryPath(onnxruntimeLibPath)
-	e := ort.InitializeEnvironment()
+// stdout, followed by the benchmark results if -benchmark was set.
+func printUpperAndLowercase(onnxruntimeLibPath, inputString string,
+	sessionConfig *sessionopts.Config,
+	benchmarkConfig *benchmark.Config) error {
+	_, e := ortlib.Initialize(onnxruntimeLibPath)
 	if e != nil {
 		return fmt.Errorf("Error initializing the onnxruntime library: %w", e)
 	}
@@ -86,14 +62,20 @@ func printUpperAndLowercase(onnxruntimeLibPath, inputString string) error {
 	}
 	defer outputLower.Destroy()
 
+	options, onnxPath, e := sessionConfig.NewSessionOptions(
+		"./example_strings.onnx")
+	if e != nil {
+		return fmt.Errorf("Error creating session options: %w", e)
+	}
+	defer options.Destroy()
+
 	// You can refer to the python script to see the input and output names.
 	// We just run the session the way we'd run any other session with
 	// onnxruntime_go, except onnxruntime populates the output strings.
-	onnxPath := "./example_strings.onnx"
 	session, e := ort.NewAdvancedSession(onnxPath,
 		[]string{"input"}, []string{"output_upper", "output_lower"},
 		[]ort.Value{inputTensor}, []ort.Value{outputUpper, outputLower},
-		nil)
+		options)
 	if e != nil {
 		return fmt.Errorf("Error creating session for %s: %w", onnxPath, e)
 	}
@@ -122,22 +104,57 @@ func printUpperAndLowercase(onnxruntimeLibPath, inputString string) error {
 	fmt.Printf("Original input: %s\n", inputString)
 	fmt.Printf("Converted to uppercase: %s\n", uppercaseString)
 	fmt.Printf("Converted to lowercase: %s\n", lowercaseString)
+	if !benchmarkConfig.Enabled() {
+		return nil
+	}
 
-	return nil
+	// When benchmarking, setting the input string counts as preprocessing,
+	// and copying the output strings out of the tensors as postprocessing.
+	timer := benchmark.NewTimer()
+	result, e := benchmarkConfig.Run("string_tensor", timer, 1, func() error {
+		timer.Stage(benchmark.Preprocess)
+		e := inputTensor.SetElement(0, inputString)
+		if e != nil {
+			return fmt.Errorf("Error setting input tensor contents: %w", e)
+		}
+		timer.Stage(benchmark.Inference)
+		e = session.Run()
+		if e != nil {
+			return fmt.Errorf("Error running %s: %w", onnxPath, e)
+		}
+		timer.Stage(benchmark.Postprocess)
+		_, e = outputUpper.GetElement(0)
+		if e != nil {
+			return fmt.Errorf("Error getting uppercase string: %w", e)
+		}
+		_, e = outputLower.GetElement(0)
+		if e != nil {
+			return fmt.Errorf("Error getting lowercase string: %w", e)
+		}
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+	return benchmarkConfig.Report(result, os.Stdout)
 }
 
 func run() int {
-	var onnxruntimeLibPath string
 	var inputString string
-	flag.StringVar(&onnxruntimeLibPath, "onnxruntime_lib",
-		getDefaultSharedLibPath(),
-		"The path to the onnxruntime shared library for your system.")
+	onnxruntimeLibPath := ortlib.AddFlag()
+	sessionConfig := sessionopts.AddFlags()
+	benchmarkConfig := benchmark.AddFlags()
 	flag.StringVar(&inputString, "input_string", "",
 		"The string to convert to upper or lowercase.")
 	flag.Parse()
-	if onnxruntimeLibPath == "" {
-		fmt.Println("You must specify a path to the onnxruntime shared " +
-			"on your system. Run with -help for more information.")
+	e := sessionConfig.Validate()
+	if e != nil {
+		fmt.Printf("Invalid session settings: %s\n", e)
+		return 1
+	}
+	e = benchmarkConfig.Validate()
+	if e != nil {
+		fmt.Printf("Invalid benchmark settings: %s\n", e)
 		return 1
 	}
 	if inputString == "" {
@@ -145,7 +162,8 @@ func run() int {
 			"more information.")
 		return 1
 	}
-	e := printUpperAndLowercase(onnxruntimeLibPath, inputString)
+	e = printUpperAndLowercase(*onnxruntimeLibPath, inputString,
+		sessionConfig, benchmarkConfig)
 	if e != nil {
 		fmt.Printf("Error running network: %s\n", e)
 		return 1
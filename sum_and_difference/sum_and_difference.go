@@ -17,49 +17,23 @@ import (
 	"flag"
 	"fmt"
 	ort "github.com/yalue/onnxruntime_go"
+	"github.com/yalue/onnxruntime_go_examples/common/benchmark"
+	"github.com/yalue/onnxruntime_go_examples/common/ortlib"
+	"github.com/yalue/onnxruntime_go_examples/common/sessionopts"
 	"os"
-	"runtime"
 )
 
-// Attempts to find and return a path to a version of the onnxruntime shared
-// library compatible with the current OS and system architecture.
-func getDefaultSharedLibPath() string {
-	// For now, the third_party directory includes libraries for x86_64
-	// windows, ARM64 and AMD64 darwin, and x86_64 or ARM64 Linux. The point of
-	// these examples is to show _how_ to select libraries, rather than to
-	// provide broad support, so this will probably not be expanded.
-	if runtime.GOOS == "windows" {
-		if runtime.GOARCH == "amd64" {
-			return "../third_party/onnxruntime.dll"
-		}
-	}
-	if runtime.GOOS == "darwin" {
-		if runtime.GOARCH == "arm64" {
-			return "../third_party/onnxruntime_arm64.dylib"
-		}
-		if runtime.GOARCH == "amd64" {
-			return "../third_party/onnxruntime_amd64.dylib"
-		}
-	}
-	if runtime.GOOS == "linux" {
-		if runtime.GOARCH == "arm64" {
-			return "../third_party/onnxruntime_arm64.so"
-		}
-		return "../third_party/onnxruntime.so"
-	}
-	fmt.Printf("Unable to determine a path to the onnxruntime shared library"+
-		" for OS \"%s\" and architecture \"%s\".\n", runtime.GOOS,
-		runtime.GOARCH)
-	return ""
-}
-
-// Actually sets up and runs the neural network. Requires a path to the
-// onnxruntime shared library file.
-func runTest(onnxruntimeLibPath string) error {
-	// Step 1: Initialize the onnxruntime library after providing a path to the
-	// shared library to use.
-	ort.SetSharedLibraryPath(onnxruntimeLibPath)
-	e := ort.InitializeEnvironment()
+// Actually sets up and runs the neural network. Takes the value of the
+// -onnxruntime_lib flag, which may be empty if the library should be searched
+// for, along with the settings from the session and benchmark flags.
+func runTest(onnxruntimeLibPath string, sessionConfig *sessionopts.Config,
+	benchmarkConfig *benchmark.Config) error {
+	// Step 1: Initialize the onnxruntime library. This amounts to calling
+	// ort.SetSharedLibraryPath() with the path to the shared library, followed
+	// by ort.InitializeEnvironment(). The ortlib package does this for each
+	// place the library may be installed, until one of them works, and checks
+	// that the library is a compatible version using ort.GetVersion().
+	_, e := ortlib.Initialize(onnxruntimeLibPath)
 	if e != nil {
 		return fmt.Errorf("Error initializing the onnxruntime library: %w", e)
 	}
@@ -98,19 +72,30 @@ func runTest(onnxruntimeLibPath string) error {
 	// Step 4: Load the network itself into an onnxruntime Session instance.
 	// Note that we call "NewAdvancedSession"---this isn't particularly
 	// "Advanced", but it's simply a newer version of the API that allows
-	// specifying additional options (which we don't use here). onnxruntime
-	// requires associating input and output tensors with names, which in this
-	// case we set to "1x4 Input Vector" and "1x2 Output Vector" when creating
-	// the network. (If you're curious, this was done when exporting the .onnx
-	// file from the the python script.) The last argument to
-	// NewAdvancedSession is a pointer to a SessionOptions instance, which we
-	// leave as nil to indicate that default options are OK.
-	session, e := ort.NewAdvancedSession("./sum_and_difference.onnx",
+	// specifying additional options. onnxruntime requires associating input
+	// and output tensors with names, which in this case we set to "1x4 Input
+	// Vector" and "1x2 Output Vector" when creating the network. (If you're
+	// curious, this was done when exporting the .onnx file from the the python
+	// script.) The last argument to NewAdvancedSession is a pointer to a
+	// SessionOptions instance, which may be nil to indicate that default
+	// options are OK. Here, we use the options configured by the command-line
+	// flags shared by all of the examples, such as -provider and
+	// -intra_op_threads. (If -optimized_model is set, the returned path may
+	// point to an optimized copy of the network.)
+	options, onnxPath, e := sessionConfig.NewSessionOptions(
+		"./sum_and_difference.onnx")
+	if e != nil {
+		return fmt.Errorf("Error creating session options: %w", e)
+	}
+	// Like tensors, SessionOptions must be destroyed when no longer needed.
+	// It's safe to destroy them as soon as the session has been created.
+	defer options.Destroy()
+	session, e := ort.NewAdvancedSession(onnxPath,
 		[]string{"1x4 Input Vector"},
 		[]string{"1x2 Output Vector"},
 		[]ort.ArbitraryTensor{inputTensor},
 		[]ort.ArbitraryTensor{outputTensor},
-		nil)
+		options)
 	if e != nil {
 		return fmt.Errorf("Error creating the session: %w", e)
 	}
@@ -122,7 +107,8 @@ func runTest(onnxruntimeLibPath string) error {
 	// Step 5: Actually run the network. This will read the data from the input
 	// tensor, and write to the output tensor. To re-run the network with
 	// different inputs, we can simply modify the inputData slice before
-	// calling Run() again. (Here, we only call it once, though.)
+	// calling Run() again. (Here, we only call it once, unless -benchmark is
+	// set.)
 	e = session.Run()
 	if e != nil {
 		return fmt.Errorf("Error executing the network: %w", e)
@@ -136,21 +122,54 @@ func runTest(onnxruntimeLibPath string) error {
 	fmt.Printf("  Input data: %v\n", inputData)
 	fmt.Printf("  Approximate sum of inputs: %f\n", outputData[0])
 	fmt.Printf("  Approximate max difference between any two inputs: %f\n", outputData[1])
-	return nil
+
+	// Step 7 (optional): If -benchmark was set, time many more runs of the
+	// network. The benchmark package reports the time spent in each stage,
+	// which we mark by calling timer.Stage(). Here, "preprocessing" is
+	// just writing the input values into the input tensor's slice, and
+	// "postprocessing" is copying the results out of the output tensor's
+	// slice.
+	if !benchmarkConfig.Enabled() {
+		return nil
+	}
+	timer := benchmark.NewTimer()
+	inputValues := append([]float32(nil), inputData...)
+	results := make([]float32, 2)
+	result, e := benchmarkConfig.Run("sum_and_difference", timer, 1,
+		func() error {
+			timer.Stage(benchmark.Preprocess)
+			copy(inputData, inputValues)
+			timer.Stage(benchmark.Inference)
+			e := session.Run()
+			if e != nil {
+				return fmt.Errorf("Error executing the network: %w", e)
+			}
+			timer.Stage(benchmark.Postprocess)
+			copy(results, outputTensor.GetData())
+			return nil
+		})
+	if e != nil {
+		return e
+	}
+	return benchmarkConfig.Report(result, os.Stdout)
 }
 
 func run() int {
-	var onnxruntimeLibPath string
-	flag.StringVar(&onnxruntimeLibPath, "onnxruntime_lib",
-		getDefaultSharedLibPath(),
-		"The path to the onnxruntime shared library for your system.")
+	onnxruntimeLibPath := ortlib.AddFlag()
+	sessionConfig := sessionopts.AddFlags()
+	benchmarkConfig := benchmark.AddFlags()
 	flag.Parse()
-	if onnxruntimeLibPath == "" {
-		fmt.Println("You must specify a path to the onnxruntime shared " +
-			"on your system. Run with -help for more information.")
+	e := sessionConfig.Validate()
+	if e != nil {
+		fmt.Printf("Invalid session settings: %s\n", e)
+		return 1
+	}
+	e = benchmarkConfig.Validate()
+	if e != nil {
+		fmt.Printf("Invalid benchmark settings: %s\n", e)
 		return 1
 	}
-	e := runTest(onnxruntimeLibPath)
+	e = runTest(*onnxruntimeLibPath, sessionConfig, benchmarkConfig)
 	if e != nil {
 		fmt.Printf("Encountered an error running the network: %s\n", e)
 		return 1